@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Tokens are stateless, so revoking sessions records the time before which
+// every token of the user is rejected. It only needs to outlive the refresh token.
+const sessionRevocationTTL = 7 * 24 * time.Hour
+
+const minPasswordLength = 8
+
+// bcrypt only looks at the first 72 bytes, longer passwords would be silently truncated
+const maxPasswordLength = 72
+
+const (
+	maxNameLength  = 100
+	maxEmailLength = 254
+)
+
+func revokeSessions(ctx context.Context, userID string) error {
+	key := fmt.Sprintf("sessions_valid_after:%s", userID)
+	return rdb.Set(ctx, key, time.Now().Unix(), sessionRevocationTTL).Err()
+}
+
+func sessionRevoked(ctx context.Context, claims *Claims) bool {
+	val, err := rdb.Get(ctx, fmt.Sprintf("sessions_valid_after:%s", claims.UserID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.ErrorContext(ctx, "failed to check session revocation", "err", err)
+		}
+		return false
+	}
+	validAfter, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false
+	}
+	return claims.IssuedAt < validAfter
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Expires: time.Unix(0, 0), MaxAge: -1, HttpOnly: true})
+	}
+}
+
+// checkPassword compares password against the stored hash like loginHandler does.
+func checkPassword(ctx context.Context, db *sql.DB, userID string, password string) (bool, error) {
+	var hashedPassword string
+	err := db.QueryRowContext(ctx, "SELECT user_password FROM user WHERE user_id = ?", userID).Scan(&hashedPassword)
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil, nil
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		slog.WarnContext(r.Context(), "parsing form error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
+		return
+	}
+
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+	if currentPassword == "" || newPassword == "" {
+		writeError(w, errInvalidForm)
+		return
+	}
+	if len(newPassword) < minPasswordLength {
+		writeError(w, newAPIError(CodeBadRequest, fmt.Sprintf("New password must be at least %d characters", minPasswordLength)))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	ok, err := checkPassword(r.Context(), db, claims.UserID, currentPassword)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch password", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if !ok {
+		writeError(w, newAPIError(CodeInvalidCredentials, "Invalid password"))
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "password hashing error", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// Log out every other device before the password changes, so the change never
+	// succeeds while old refresh tokens stay valid. This device gets fresh tokens below.
+	err = revokeSessions(r.Context(), claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to revoke sessions", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE user SET user_password = ? WHERE user_id = ?", hashedPassword, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update password", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	user, err := fetchUser(r.Context(), db, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if err := issueSession(w, user); err != nil {
+		slog.ErrorContext(r.Context(), "create token error", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Password changed"})
+}
+
+// deleteAccount closes the account of the authenticated user. The user row is kept
+// but anonymized so orders and carts of other users still reference a valid id.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		slog.WarnContext(r.Context(), "parsing form error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
+		return
+	}
+	password := r.FormValue("user_password")
+	if password == "" {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	ok, err := checkPassword(r.Context(), db, claims.UserID, password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch password", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if !ok {
+		writeError(w, newAPIError(CodeInvalidCredentials, "Invalid password"))
+		return
+	}
+
+	user, err := fetchUser(r.Context(), db, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	images, err := userUploads(r.Context(), db, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	err = anonymizeUser(r.Context(), db, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete account", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// The rows are gone at this point, failures below are logged but do not fail the request.
+	// Images other users share or that were written within the GC grace are left to the sweeper.
+	if err := deleteUnreferencedUploads(r.Context(), db, images, config.UploadGCGrace); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete user images", "err", err)
+	}
+	if err := revokeSessions(r.Context(), claims.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to revoke sessions", "err", err)
+	}
+	invalidateProductCache(r.Context())
+	clearSessionCookies(w)
+
+	goBackground(func() { sendAccountDeletedMail(user.Email, user.Name) })
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Account deleted"})
+}
+
+func userUploads(ctx context.Context, db *sql.DB, user User) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT product_image_url FROM product WHERE seller_id = ? UNION SELECT i.product_image_url FROM product_image i JOIN product p ON p.product_id = i.product_id WHERE p.seller_id = ?", user.ID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		images = append(images, url)
+	}
+	if user.Photo != "" {
+		images = append(images, user.Photo)
+	}
+	return images, rows.Err()
+}
+
+func anonymizeUser(ctx context.Context, db *sql.DB, userID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE user SET user_name = ?, user_email = CONCAT('deleted-', user_id, '@deleted.invalid'), user_password = '', user_gender = NULL, user_phone = NULL, user_address = NULL, user_photo = NULL, user_status = ?, user_totp_secret = NULL, user_totp_enabled = 0 WHERE user_id = ?", []interface{}{"Deleted user", UserStatusDeleted, userID}},
+		{"DELETE FROM user_recovery_code WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM cart WHERE buyer_id = ? OR seller_id = ?", []interface{}{userID, userID}},
+		{"DELETE i FROM product_image i JOIN product p ON p.product_id = i.product_id WHERE p.seller_id = ?", []interface{}{userID}},
+		{"UPDATE product SET product_status = ?, product_image_url = '' WHERE seller_id = ?", []interface{}{ProductStatusDeleted, userID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sendAccountDeletedMail(email string, name string) {
+	scriptURL := config.AccountDeletedMailURL
+	if scriptURL == "" {
+		slog.Warn("TANAM_ACCOUNT_DELETED_MAIL_URL not set, skipping account deletion email")
+		return
+	}
+
+	err := postMail(scriptURL, map[string]interface{}{
+		"email": email,
+		"name":  name,
+	})
+	countEmail("account_deleted", err)
+	if err != nil {
+		slog.Error("failed to send account deletion email", "err", err)
+		return
+	}
+	slog.Info("account deletion email sent")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"tanamdev/validation"
+)
+
+// ErrorCode is the machine readable reason of a failed request. Codes are part of
+// the API, clients switch on them, so existing ones must never change meaning.
+type ErrorCode string
+
+const (
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeValidation         ErrorCode = "validation_failed"
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeInvalidCredentials ErrorCode = "invalid_credentials"
+	CodeInvalidAPIKey      ErrorCode = "invalid_api_key"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeAccountBanned      ErrorCode = "account_banned"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeMethodNotAllowed   ErrorCode = "method_not_allowed"
+	CodeConflict           ErrorCode = "conflict"
+	CodePayloadTooLarge    ErrorCode = "payload_too_large"
+	CodeUnsupportedMedia   ErrorCode = "unsupported_media_type"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeInternal           ErrorCode = "internal_error"
+	CodeUpstream           ErrorCode = "upstream_failed"
+	CodeUnavailable        ErrorCode = "service_unavailable"
+	CodeTimeout            ErrorCode = "timeout"
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeBadRequest:         http.StatusBadRequest,
+	CodeValidation:         http.StatusBadRequest,
+	CodeUnauthorized:       http.StatusUnauthorized,
+	CodeInvalidCredentials: http.StatusUnauthorized,
+	CodeInvalidAPIKey:      http.StatusUnauthorized,
+	CodeForbidden:          http.StatusForbidden,
+	CodeAccountBanned:      http.StatusForbidden,
+	CodeNotFound:           http.StatusNotFound,
+	CodeMethodNotAllowed:   http.StatusMethodNotAllowed,
+	CodeConflict:           http.StatusConflict,
+	CodePayloadTooLarge:    http.StatusRequestEntityTooLarge,
+	CodeUnsupportedMedia:   http.StatusUnsupportedMediaType,
+	CodeRateLimited:        http.StatusTooManyRequests,
+	CodeInternal:           http.StatusInternalServerError,
+	CodeUpstream:           http.StatusBadGateway,
+	CodeUnavailable:        http.StatusServiceUnavailable,
+	CodeTimeout:            http.StatusGatewayTimeout,
+}
+
+// APIError is the error body of every failed request. Message is safe to show to
+// the user, the underlying cause is only logged.
+type APIError struct {
+	Code    ErrorCode         `json:"code"`
+	Message string            `json:"message"`
+	Fields  validation.Errors `json:"fields,omitempty"`
+	// RequestID is filled in when written so a client can quote it in a bug report
+	RequestID string `json:"request_id,omitempty"`
+	cause     error
+}
+
+func (e *APIError) Error() string {
+	if e.cause != nil {
+		return string(e.Code) + ": " + e.Message + ": " + e.cause.Error()
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.cause
+}
+
+func (e *APIError) Status() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func newAPIError(code ErrorCode, message string) *APIError {
+	return &APIError{Code: code, Message: message}
+}
+
+// internalError hides err from the client and logs it when written.
+func internalError(err error) *APIError {
+	return &APIError{Code: CodeInternal, Message: "Internal server error", cause: err}
+}
+
+var (
+	errInternal         = newAPIError(CodeInternal, "Internal server error") // for causes the caller logged itself
+	errInvalidJSON      = newAPIError(CodeBadRequest, "Invalid JSON")
+	errInvalidForm      = newAPIError(CodeBadRequest, "Invalid form")
+	errUnauthorized     = newAPIError(CodeUnauthorized, "Unauthorized")
+	errForbidden        = newAPIError(CodeForbidden, "Forbidden")
+	errMethodNotAllowed = newAPIError(CodeMethodNotAllowed, "Method not allowed")
+	errRateLimited      = newAPIError(CodeRateLimited, "Too many requests")
+
+	errInvalidCredentials = newAPIError(CodeInvalidCredentials, "Invalid email or password")
+	errAccountBanned      = newAPIError(CodeAccountBanned, "Account suspended")
+	errMailFailed         = newAPIError(CodeUpstream, "Failed to send email")
+	errDatabase           = newAPIError(CodeUnavailable, "Database unavailable")
+	errTimeout            = newAPIError(CodeTimeout, "Request timed out")
+)
+
+// toAPIError maps any error a handler ends up with to what the client gets to see.
+// Errors that are not known to be safe become a generic internal error.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	var fieldErrs validation.Errors
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &fieldErrs):
+		return &APIError{Code: CodeValidation, Message: "Invalid input", Fields: fieldErrs}
+	case errors.As(err, &maxBytesErr):
+		return &APIError{Code: CodePayloadTooLarge, Message: "Request body too large", cause: err}
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, errBlobNotFound):
+		return &APIError{Code: CodeNotFound, Message: "Not found", cause: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &APIError{Code: CodeTimeout, Message: "Request timed out", cause: err}
+	}
+	return internalError(err)
+}
+
+// bodyError is the answer to a request body that could not be parsed: a 413 when the
+// body went over its BodyLimitMiddleware limit, invalid otherwise.
+func bodyError(err error, invalid *APIError) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return invalid
+}
+
+// writeError answers a failed request. The body keeps the status and data fields
+// older clients read, data holds the message.
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := *toAPIError(err) // a copy, the shared errors must not be modified
+	apiErr.RequestID = w.Header().Get("X-Request-ID")
+	status := apiErr.Status()
+	if status >= http.StatusInternalServerError && apiErr.cause != nil {
+		slog.Error("request failed", "request_id", apiErr.RequestID, "error_code", apiErr.Code, "err", apiErr.cause)
+	}
+	sendJSONResponse(w, status, Response{Status: "failed", Data: apiErr.Message, Error: &apiErr})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Handlers parsing their own body answer a body over the limit with a 413, not as a malformed body.
+func TestBodyErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		contentType string
+		body        string
+		want        int
+	}{
+		{"form over limit", loginHandler, "application/x-www-form-urlencoded", "user_email=" + strings.Repeat("a", 2048), http.StatusRequestEntityTooLarge},
+		{"malformed form", loginHandler, "application/x-www-form-urlencoded", "user_email=%zz", http.StatusBadRequest},
+		{"json over limit", addCart, "application/json", `{"product_id":"` + strings.Repeat("1", 2048) + `"}`, http.StatusRequestEntityTooLarge},
+		{"malformed json", addCart, "application/json", `{"product_id":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		r.ContentLength = -1 // streamed, so only reading the body finds out it is too large
+		w := httptest.NewRecorder()
+		BodyLimitMiddleware(1024)(tt.handler).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type APIKey struct {
+	ID         int        `json:"api_key_id"`
+	Name       string     `json:"api_key_name"`
+	Owner      string     `json:"api_key_owner"`
+	Prefix     string     `json:"api_key_prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"api_key_scopes"`
+	RateLimit  int        `json:"api_key_rate_limit"` // requests per minute, 0 means unlimited
+	CreatedAt  time.Time  `json:"api_key_created_at"`
+	ExpiresAt  *time.Time `json:"api_key_expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"api_key_last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"api_key_revoked_at,omitempty"`
+}
+
+// cachedAPIKey is what gets stored in redis, it keeps the hash that APIKey hides from JSON.
+type cachedAPIKey struct {
+	APIKey
+	Hash string `json:"api_key_hash"`
+}
+
+type APIKeyRequest struct {
+	Name          string   `json:"api_key_name"`
+	Owner         string   `json:"api_key_owner"`
+	Scopes        []string `json:"api_key_scopes"`
+	RateLimit     int      `json:"api_key_rate_limit"`
+	ExpiresInDays int      `json:"api_key_expires_in_days,omitempty"`
+}
+
+type contextKey string
+
+const apiKeyContextKey contextKey = "api_key"
+
+const (
+	apiKeyPrefix   = "tnm"
+	apiKeyCacheTTL = time.Minute
+)
+
+// legacyAPIKey is the key every client shared before per-client keys. App versions
+// that still send it resolve to the row seeded under legacyAPIKeyPrefix, which
+// expires and can be revoked like any other key.
+const (
+	legacyAPIKey       = "tanam_api_key"
+	legacyAPIKeyPrefix = "legacy00"
+)
+
+var (
+	errAPIKeyInvalid = errors.New("invalid api key")
+	errAPIKeyExpired = errors.New("api key expired")
+	errAPIKeyRevoked = errors.New("api key revoked")
+)
+
+// generateAPIKey returns a new plaintext key of the form tnm_<prefix>_<secret>.
+// The prefix is stored in clear so the key can be looked up, the whole key is only stored hashed.
+func generateAPIKey() (plain string, prefix string, err error) {
+	prefixBytes := make([]byte, 4)
+	if _, err = rand.Read(prefixBytes); err != nil {
+		return "", "", err
+	}
+	secretBytes := make([]byte, 24)
+	if _, err = rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(prefixBytes)
+	plain = fmt.Sprintf("%s_%s_%s", apiKeyPrefix, prefix, base64.RawURLEncoding.EncodeToString(secretBytes))
+	return plain, prefix, nil
+}
+
+func hashAPIKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseAPIKeyPrefix(plain string) (string, bool) {
+	if plain == legacyAPIKey {
+		return legacyAPIKeyPrefix, true
+	}
+	// The secret is base64url and may itself contain underscores
+	parts := strings.SplitN(plain, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || len(parts[1]) != 8 || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func apiKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(*APIKey)
+	return key, ok
+}
+
+func insertAPIKey(ctx context.Context, db *sql.DB, req APIKeyRequest) (*APIKey, string, error) {
+	plain, prefix, err := generateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		Name:      req.Name,
+		Owner:     req.Owner,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(plain),
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := key.CreatedAt.Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		key.ExpiresAt = &expiresAt
+	}
+
+	stmt, err := db.PrepareContext(ctx, "INSERT INTO api_key (api_key_name, api_key_owner, api_key_prefix, api_key_hash, api_key_scopes, api_key_rate_limit, api_key_created_at, api_key_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, "", err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, key.Name, key.Owner, key.Prefix, key.Hash, strings.Join(key.Scopes, ","), key.RateLimit, key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+	key.ID = int(id)
+
+	return key, plain, nil
+}
+
+func scanAPIKey(scanner interface{ Scan(...any) error }) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := scanner.Scan(&key.ID, &key.Name, &key.Owner, &key.Prefix, &key.Hash, &scopes, &key.RateLimit, &key.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return &key, nil
+}
+
+const apiKeyColumns = "api_key_id, api_key_name, api_key_owner, api_key_prefix, api_key_hash, api_key_scopes, api_key_rate_limit, api_key_created_at, api_key_expires_at, api_key_last_used_at, api_key_revoked_at"
+
+// lookupAPIKey finds a key by its public prefix, going through redis first so
+// that the database is not hit on every request.
+func lookupAPIKey(ctx context.Context, prefix string) (*APIKey, error) {
+	cacheKey := fmt.Sprintf("api_key:%s", prefix)
+	cached, err := rdb.Get(ctx, cacheKey).Result()
+	if err == nil {
+		var entry cachedAPIKey
+		if err := json.Unmarshal([]byte(cached), &entry); err == nil {
+			entry.APIKey.Hash = entry.Hash
+			return &entry.APIKey, nil
+		}
+	} else if err != redis.Nil {
+		slog.ErrorContext(ctx, "failed to retrieve api key cache", "err", err)
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scanAPIKey(db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_key WHERE api_key_prefix = ?", prefix))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errAPIKeyInvalid
+		}
+		return nil, err
+	}
+
+	cacheData, err := json.Marshal(cachedAPIKey{APIKey: *key, Hash: key.Hash})
+	if err == nil {
+		if err := rdb.Set(ctx, cacheKey, cacheData, apiKeyCacheTTL).Err(); err != nil {
+			slog.ErrorContext(ctx, "failed to set api key cache", "err", err)
+		}
+	}
+	return key, nil
+}
+
+// verifyAPIKey checks a plaintext key against its stored hash in constant time.
+func verifyAPIKey(ctx context.Context, plain string) (*APIKey, error) {
+	prefix, ok := parseAPIKeyPrefix(plain)
+	if !ok {
+		return nil, errAPIKeyInvalid
+	}
+
+	key, err := lookupAPIKey(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(plain)), []byte(key.Hash)) != 1 {
+		return nil, errAPIKeyInvalid
+	}
+	if key.RevokedAt != nil {
+		return nil, errAPIKeyRevoked
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, errAPIKeyExpired
+	}
+	return key, nil
+}
+
+// touchAPIKey records last usage, at most once per minute per key.
+func touchAPIKey(key *APIKey) {
+	ctx := context.Background()
+	set, err := rdb.SetNX(ctx, fmt.Sprintf("api_key_used:%d", key.ID), 1, time.Minute).Result()
+	if err != nil || !set {
+		return
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		slog.Error("failed to update api key last used", "err", err)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE api_key SET api_key_last_used_at = ? WHERE api_key_id = ?", time.Now().UTC(), key.ID)
+	if err != nil {
+		slog.Error("failed to update api key last used", "err", err)
+	}
+}
+
+func APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check for API key in the request headers
+		key, err := verifyAPIKey(r.Context(), r.Header.Get("X-API-Key"))
+		if err != nil {
+			if err == errAPIKeyInvalid || err == errAPIKeyExpired || err == errAPIKeyRevoked {
+				slog.Warn("API key unauthorized", "err", err)
+				writeError(w, newAPIError(CodeInvalidAPIKey, "Invalid API key"))
+				return
+			}
+			slog.Error("API key lookup error", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+
+		// Every key has its own budget, keys shared by all installs of an app are
+		// usually unlimited and rely on the per IP and per route limits instead
+		if key.RateLimit > 0 {
+			res, err := rateLimiter.Allow(r.Context(), "api_key:"+strconv.Itoa(key.ID), PerMinute(key.RateLimit))
+			if err != nil {
+				slog.Error("API key rate limit error", "err", err)
+			} else {
+				writeRateLimitHeaders(w, res)
+				if !res.Allowed {
+					writeError(w, errRateLimited)
+					return
+				}
+			}
+		}
+
+		goBackground(func() { touchAPIKey(key) })
+
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.APIKeyID = key.ID
+		}
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope only lets through requests whose API key carries the given scope.
+// It must run after APIKeyMiddleware, so list it before APIKeyMiddleware in ChainMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := apiKeyFromContext(r.Context())
+			if !ok || !key.HasScope(scope) {
+				writeError(w, newAPIError(CodeForbidden, "API key lacks the required scope"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+	if req.Name == "" || req.Owner == "" || req.RateLimit < 0 || req.ExpiresInDays < 0 {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	key, plain, err := insertAPIKey(r.Context(), db, req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to insert api key", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// The plaintext key is only ever returned here.
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: map[string]interface{}{
+		"api_key":         plain,
+		"api_key_details": key,
+	}})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID int `json:"api_key_id"`
+	}
+	if id, ok := pathID(r, "id"); ok {
+		req.ID = id
+		if req.ID == 0 {
+			writeError(w, newAPIError(CodeNotFound, "API key not found"))
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var prefix string
+	err = db.QueryRowContext(r.Context(), "SELECT api_key_prefix FROM api_key WHERE api_key_id = ?", req.ID).Scan(&prefix)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, newAPIError(CodeNotFound, "API key not found"))
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to fetch api key", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE api_key SET api_key_revoked_at = ? WHERE api_key_id = ? AND api_key_revoked_at IS NULL", time.Now().UTC(), req.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to revoke api key", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// Drop the cached copy so the revocation takes effect immediately.
+	if err := rdb.Del(r.Context(), fmt.Sprintf("api_key:%s", prefix)).Err(); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete api key cache", "err", err)
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "API key revoked"})
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), "SELECT "+apiKeyColumns+" FROM api_key ORDER BY api_key_id")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch api keys", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to scan api key", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch api keys", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: keys})
+}
+
+// runAPIKeyCommand issues a key from the command line, which is how the first
+// admin key gets created:
+//
+//	tanamdev apikey -name mobile-app -owner tanam -scopes app,admin
+func runAPIKeyCommand(args []string) {
+	fs := flag.NewFlagSet("apikey", flag.ExitOnError)
+	name := fs.String("name", "", "key name")
+	owner := fs.String("owner", "", "key owner")
+	scopes := fs.String("scopes", "app", "comma separated scopes")
+	rateLimit := fs.Int("rate", 0, "requests per minute, 0 for unlimited")
+	expiresInDays := fs.Int("expires", 0, "days until expiry, 0 for never")
+	fs.Parse(args)
+
+	if *name == "" || *owner == "" {
+		log.Fatal("apikey: -name and -owner are required")
+	}
+
+	db, err := openDB(context.Background())
+	if err != nil {
+		log.Fatalf("apikey: %v", err)
+	}
+
+	key, plain, err := insertAPIKey(context.Background(), db, APIKeyRequest{
+		Name:          *name,
+		Owner:         *owner,
+		Scopes:        strings.Split(*scopes, ","),
+		RateLimit:     *rateLimit,
+		ExpiresInDays: *expiresInDays,
+	})
+	if err != nil {
+		log.Fatalf("apikey: %v", err)
+	}
+	fmt.Printf("Created api key %d (%s)\n%s\n", key.ID, key.Name, plain)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+	"testing"
+)
+
+// Every generated key has to parse back to its prefix and match its stored hash,
+// whatever characters its random secret happens to contain.
+func TestAPIKeyRoundTrip(t *testing.T) {
+	underscores := 0
+	for i := 0; i < 2000; i++ {
+		plain, prefix, err := generateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := hashAPIKey(plain)
+
+		parsed, ok := parseAPIKeyPrefix(plain)
+		if !ok || parsed != prefix {
+			t.Fatalf("parseAPIKeyPrefix(%q) = %q, %v, want %q", plain, parsed, ok, prefix)
+		}
+		if subtle.ConstantTimeCompare([]byte(hashAPIKey(plain)), []byte(hash)) != 1 {
+			t.Fatalf("hash of %q does not verify", plain)
+		}
+		if strings.Count(plain, "_") > 2 {
+			underscores++
+		}
+	}
+	if underscores == 0 {
+		t.Error("no generated secret contained an underscore, the round trip proves little")
+	}
+}
+
+func TestParseAPIKeyPrefix(t *testing.T) {
+	tests := []struct {
+		plain  string
+		prefix string
+		ok     bool
+	}{
+		{"tnm_0a1b2c3d_c2VjcmV0", "0a1b2c3d", true},
+		{"tnm_0a1b2c3d_se_cr_et", "0a1b2c3d", true},
+		{legacyAPIKey, legacyAPIKeyPrefix, true},
+		{"", "", false},
+		{"tnm_0a1b2c3d_", "", false},
+		{"tnm_0a1b2c3d", "", false},
+		{"tnm_0a1b_c2VjcmV0", "", false},
+		{"key_0a1b2c3d_c2VjcmV0", "", false},
+	}
+	for _, tt := range tests {
+		prefix, ok := parseAPIKeyPrefix(tt.plain)
+		if prefix != tt.prefix || ok != tt.ok {
+			t.Errorf("parseAPIKeyPrefix(%q) = %q, %v, want %q, %v", tt.plain, prefix, ok, tt.prefix, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// Blob is an open stored object. It is seekable so it can go straight into http.ServeContent.
+type Blob interface {
+	io.ReadSeekCloser
+	Info() BlobInfo
+}
+
+// BlobStore is where uploaded files live. Keys are slash separated and relative,
+// e.g. "3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (Blob, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// Move renames src to dst, replacing dst if it exists. Readers see either the
+	// old or the new dst, never a partial one.
+	Move(ctx context.Context, src string, dst string) error
+	// List calls fn for every blob whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(BlobInfo) error) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var errBlobKey = errors.New("invalid blob key")
+
+// BlobVisibility decides who may load a blob. Public blobs are served to anyone,
+// private ones only through a signed URL, see signImageURL.
+type BlobVisibility int
+
+const (
+	BlobPublic BlobVisibility = iota
+	BlobPrivate
+)
+
+// The visibility is part of the key, so it survives in any store and in stored URLs.
+const privateBlobPrefix = "private/"
+
+func blobKey(name string, visibility BlobVisibility) string {
+	if visibility == BlobPrivate {
+		return privateBlobPrefix + name
+	}
+	return name
+}
+
+func blobPrivate(key string) bool {
+	return strings.HasPrefix(key, privateBlobPrefix)
+}
+
+// blobStore is set up by main from config before any handler runs.
+var blobStore BlobStore
+
+func newBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case "local":
+		return newLocalBlobStore(cfg.UploadDir), nil
+	case "s3":
+		return newS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown blob store %q", cfg.BlobStore)
+}
+
+// imageURL is the public URL loadImage serves key under.
+func imageURL(key string) string {
+	return config.PublicBaseURL + "/api/tanam/loadimage/" + key
+}
+
+// blobKeyFromURL is the reverse of imageURL. URLs stored before the blob store
+// existed carry an extra uploads/ segment, only the last segment is the key
+// apart from the private/ prefix.
+func blobKeyFromURL(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	key := path.Base(url)
+	if path.Base(path.Dir(url))+"/" == privateBlobPrefix {
+		key = privateBlobPrefix + key
+	}
+	return key
+}
+
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) *localBlobStore {
+	return &localBlobStore{root: root}
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", errBlobKey
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes next to the destination and renames, so a half written file is never served.
+func (s *localBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+type localBlob struct {
+	*os.File
+	info BlobInfo
+}
+
+func (b *localBlob) Info() BlobInfo {
+	return b.info
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (Blob, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localBlob{File: file, info: BlobInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}}, nil
+}
+
+func (s *localBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return BlobInfo{}, errBlobNotFound
+		}
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.pruneDirs(filepath.Dir(p))
+	return nil
+}
+
+// pruneDirs removes dir and its parents below the root as long as they are empty,
+// so staging directories do not pile up.
+func (s *localBlobStore) pruneDirs(dir string) {
+	root := filepath.Clean(s.root)
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s *localBlobStore) Move(ctx context.Context, src string, dst string) error {
+	srcPath, err := s.path(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	err = os.Rename(srcPath, dstPath)
+	if os.IsNotExist(err) {
+		return errBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	s.pruneDirs(filepath.Dir(srcPath))
+	return nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	err := filepath.WalkDir(s.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and temporary files of writes in progress
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3BlobStore talks to anything speaking the S3 API: AWS, MinIO, R2, ...
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3BlobStore(cfg Config) (*s3BlobStore, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{client: client, bucket: cfg.S3Bucket}, nil
+}
+
+func s3NotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if !validBlobKey(key) {
+		return errBlobKey
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+type s3Blob struct {
+	*minio.Object
+	info BlobInfo
+}
+
+func (b *s3Blob) Info() BlobInfo {
+	return b.info
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (Blob, error) {
+	if !validBlobKey(key) {
+		return nil, errBlobKey
+	}
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, Stat is what actually reaches the server
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if s3NotFound(err) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	return &s3Blob{Object: object, info: BlobInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified, ContentType: stat.ContentType}}, nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	if !validBlobKey(key) {
+		return BlobInfo{}, errBlobKey
+	}
+	stat, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if s3NotFound(err) {
+			return BlobInfo{}, errBlobNotFound
+		}
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified, ContentType: stat.ContentType}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	if !validBlobKey(key) {
+		return errBlobKey
+	}
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// Move is a server side copy followed by a delete, S3 has no rename. A copy of a
+// single object is atomic for readers of dst.
+func (s *s3BlobStore) Move(ctx context.Context, src string, dst string) error {
+	if !validBlobKey(src) || !validBlobKey(dst) {
+		return errBlobKey
+	}
+	_, err := s.client.CopyObject(ctx, minio.CopyDestOptions{Bucket: s.bucket, Object: dst}, minio.CopySrcOptions{Bucket: s.bucket, Object: src})
+	if err != nil {
+		if s3NotFound(err) {
+			return errBlobNotFound
+		}
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, src, minio.RemoveObjectOptions{})
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	// Cancelling stops the listing goroutine when fn returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		err := fn(BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified, ContentType: object.ContentType})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
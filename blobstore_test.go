@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// useTestBlobStore points the blobStore handlers use at store for the rest of the test.
+func useTestBlobStore(t *testing.T, store BlobStore) {
+	saved := blobStore
+	blobStore = store
+	t.Cleanup(func() { blobStore = saved })
+}
+
+// testBlobStore checks the BlobStore contract every implementation has to keep.
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	put := func(key string, data string) {
+		t.Helper()
+		if err := store.Put(ctx, key, []byte(data), "image/png"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	read := func(key string) string {
+		t.Helper()
+		blob, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		defer blob.Close()
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("reading %q: %v", key, err)
+		}
+		if blob.Info().Size != int64(len(data)) {
+			t.Errorf("Get(%q) size = %d, read %d bytes", key, blob.Info().Size, len(data))
+		}
+		return string(data)
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		put("a.png", "first")
+		put("a.png", "second")
+		if got := read("a.png"); got != "second" {
+			t.Errorf("Get after overwrite = %q, want %q", got, "second")
+		}
+		info, err := store.Stat(ctx, "a.png")
+		if err != nil || info.Size != int64(len("second")) || info.ModTime.IsZero() {
+			t.Errorf("Stat = %+v, %v", info, err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := store.Get(ctx, "missing.png"); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("Get missing: %v, want errBlobNotFound", err)
+		}
+		if _, err := store.Stat(ctx, "missing.png"); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("Stat missing: %v, want errBlobNotFound", err)
+		}
+		if err := store.Move(ctx, "missing.png", "b.png"); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("Move missing: %v, want errBlobNotFound", err)
+		}
+		if err := store.Delete(ctx, "missing.png"); err != nil {
+			t.Errorf("Delete missing: %v", err)
+		}
+	})
+
+	t.Run("move replaces destination", func(t *testing.T) {
+		put("staging/1/m.png", "new")
+		put("m.png", "old")
+		if err := store.Move(ctx, "staging/1/m.png", "m.png"); err != nil {
+			t.Fatalf("Move: %v", err)
+		}
+		if got := read("m.png"); got != "new" {
+			t.Errorf("Get after Move = %q, want %q", got, "new")
+		}
+		if _, err := store.Stat(ctx, "staging/1/m.png"); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("source after Move: %v, want errBlobNotFound", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		put("d.png", "x")
+		if err := store.Delete(ctx, "d.png"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.Stat(ctx, "d.png"); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("Stat after Delete: %v, want errBlobNotFound", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		put("private/p.png", "p")
+		put("private/q.png", "q")
+		var keys []string
+		err := store.List(ctx, "private/", func(info BlobInfo) error {
+			keys = append(keys, info.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != "private/p.png,private/q.png" {
+			t.Errorf("List(private/) = %v", keys)
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err = store.List(ctx, "", func(BlobInfo) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("List stopping early = %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		for _, key := range []string{"", "/abs.png", "../up.png", "a/../b.png", "a//b.png", `a\b.png`} {
+			if err := store.Put(ctx, key, []byte("x"), "image/png"); !errors.Is(err, errBlobKey) {
+				t.Errorf("Put(%q) = %v, want errBlobKey", key, err)
+			}
+			if _, err := store.Get(ctx, key); !errors.Is(err, errBlobKey) {
+				t.Errorf("Get(%q) = %v, want errBlobKey", key, err)
+			}
+		}
+	})
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	root := t.TempDir()
+	store := newLocalBlobStore(root)
+	testBlobStore(t, store)
+
+	// Moving the last blob out of a staging directory removes the directory
+	if _, err := os.Stat(filepath.Join(root, "staging")); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+	// Writes go through temporary files that must not be left behind or listed
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".upload-") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+// TestS3BlobStore runs against an in-process S3 fake, so it needs no MinIO or network.
+func TestS3BlobStore(t *testing.T) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("tanam-test"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	defer server.Close()
+
+	store, err := newS3BlobStore(Config{
+		S3Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		S3Region:    "us-east-1",
+		S3Bucket:    "tanam-test",
+		S3AccessKey: "test",
+		S3SecretKey: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestBlobKeyFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{imageURL("3a7b.jpg"), "3a7b.jpg"},
+		{imageURL(blobKey("3a7b.jpg", BlobPrivate)), "private/3a7b.jpg"},
+		{imageURL("private/3a7b.jpg") + "?expires=1700000000&sig=abc", "private/3a7b.jpg"},
+		{imageURL("3a7b_w400.jpg") + "#top", "3a7b_w400.jpg"},
+		// Stored before the blob store existed
+		{"https://api.tanam.software:8488/api/tanam/loadimage/uploads/photo.png", "photo.png"},
+		{"uploads/photo.png", "photo.png"},
+	}
+	for _, tt := range tests {
+		if got := blobKeyFromURL(tt.url); got != tt.want {
+			t.Errorf("blobKeyFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
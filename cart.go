@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
-	"strconv"
+
+	"tanamdev/validation"
 )
 
+const maxCartQuantity = 1000
+
 type CartRequest struct {
 	ProductID    string `json:"product_id"`
 	CartQuantity string `json:"cart_quantity"`
@@ -21,8 +24,8 @@ func addCart(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 
 	if err != nil {
-		log.Printf("JSON decoding error: %v\n", err)
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: "Invalid JSON"})
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
 		return
 	}
 
@@ -31,75 +34,78 @@ func addCart(w http.ResponseWriter, r *http.Request) {
 	cart_price := req.CartPrice
 	buyer_id := req.BuyerID
 	seller_id := req.SellerID
-	price, err := strconv.ParseFloat(cart_price, 64)
-	if err != nil {
-		http.Error(w, "Invalid product price", http.StatusBadRequest)
-		return
+	v := validation.New()
+	if v.Required("product_id", product_id) {
+		v.Int("product_id", product_id, 1, math.MaxInt32)
 	}
-	quantity, err := strconv.Atoi(cart_quantity)
-	if err != nil {
-		http.Error(w, "Invalid product quantity", http.StatusBadRequest)
-		return
+	var quantity int
+	if v.Required("cart_quantity", cart_quantity) {
+		quantity = v.Int("cart_quantity", cart_quantity, 1, maxCartQuantity)
+	}
+	var price float64
+	if v.Required("cart_price", cart_price) {
+		price = v.Float("cart_price", cart_price, 0, maxProductPrice)
+	}
+	if v.Required("buyer_id", buyer_id) {
+		v.Int("buyer_id", buyer_id, 1, math.MaxInt32)
+	}
+	if v.Required("seller_id", seller_id) {
+		v.Int("seller_id", seller_id, 1, math.MaxInt32)
 	}
-	fmt.Println(product_id)
-	fmt.Println(cart_quantity)
-	fmt.Println(cart_price)
-	fmt.Println(buyer_id)
-	fmt.Println(seller_id)
-	if product_id == "" || cart_quantity == "" || cart_price == "" || buyer_id == "" || seller_id == "" {
-		fmt.Println("Form empty error")
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: nil})
+	slog.DebugContext(r.Context(), "add cart", "product_id", product_id, "quantity", cart_quantity, "seller_id", seller_id)
+	if !v.Valid() {
+		slog.InfoContext(r.Context(), "form validation failed", "errors", v.Errors())
+		writeError(w, v.Errors())
 		return
 	}
-	db, err := dbConnect(w)
+	db, err := dbConnect(r.Context(), w)
 	if err != nil {
-		fmt.Println("dbconnect error:", err.Error())
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
 		return
 	}
-	defer db.Close()
 
 	//check if user already add this product to his cart before or not
-	stmtCount, err := db.Prepare("SELECT COUNT(*) FROM cart WHERE buyer_id = ? AND product_id = ?")
+	stmtCount, err := db.PrepareContext(r.Context(), "SELECT COUNT(*) FROM cart WHERE buyer_id = ? AND product_id = ?")
 	if err != nil {
-		fmt.Println("SQL Prepare error0:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err})
+		slog.ErrorContext(r.Context(), "SQL Prepare error0", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer stmtCount.Close()
 
 	var count int
-	err = stmtCount.QueryRow(buyer_id, product_id).Scan(&count)
+	err = stmtCount.QueryRowContext(r.Context(), buyer_id, product_id).Scan(&count)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		writeError(w, internalError(err))
 		return
 	}
 	if count > 0 {
-		stmt, err := db.Prepare("UPDATE cart SET cart_quantity = ?, cart_price = ? WHERE buyer_id = ? AND product_id = ?")
+		stmt, err := db.PrepareContext(r.Context(), "UPDATE cart SET cart_quantity = ?, cart_price = ? WHERE buyer_id = ? AND product_id = ?")
 		if err != nil {
-			fmt.Println("SQL Prepare error1:", err.Error())
-			sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err})
+			slog.ErrorContext(r.Context(), "SQL Prepare error1", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 		defer stmtCount.Close()
-		_, err = stmt.Exec(quantity, price, buyer_id, product_id, seller_id)
+		_, err = stmt.ExecContext(r.Context(), quantity, price, buyer_id, product_id, seller_id)
 		if err != nil {
-			log.Printf("SQL execution error2: %v\n", err)
-			sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err.Error()})
+			slog.ErrorContext(r.Context(), "SQL execution error2", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 
 	} else {
-		stmt, err := db.Prepare("INSERT INTO cart (cart_quantity, cart_price, buyer_id, product_id, seller_id) VALUES(?, ?, ?, ?, ?)")
+		stmt, err := db.PrepareContext(r.Context(), "INSERT INTO cart (cart_quantity, cart_price, buyer_id, product_id, seller_id) VALUES(?, ?, ?, ?, ?)")
 		if err != nil {
-			fmt.Println("SQL Prepare error3:", err.Error())
-			sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err})
+			slog.ErrorContext(r.Context(), "SQL Prepare error3", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 		defer stmtCount.Close()
-		_, err = stmt.Exec(quantity, price, buyer_id, product_id, seller_id)
+		_, err = stmt.ExecContext(r.Context(), quantity, price, buyer_id, product_id, seller_id)
 		if err != nil {
-			log.Printf("SQL execution error: %v\n", err)
-			sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err.Error()})
+			slog.ErrorContext(r.Context(), "SQL execution error", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is read once from the environment at startup, every setting has a
+// default matching the production deployment.
+type Config struct {
+	Env string // "production" or "development", picks the defaults below
+
+	HTTPSAddr       string // listener of the API when TLS is on
+	HTTPAddr        string // listener of the API without TLS, otherwise of the redirect to HTTPS
+	TLSMode         string // "off", "files", "acme" or "self-signed", see tls.go
+	TLSCertFile     string
+	TLSKeyFile      string
+	ACMEDomains     []string // hosts ACME may get certificates for
+	ACMECacheDir    string   // keeps ACME accounts and certificates across restarts
+	ACMEEmail       string   // contact for expiry notices, optional
+	HSTSMaxAge      time.Duration
+	GlobalRateLimit int // requests per minute and IP over all routes, 0 disables it
+
+	PublicBaseURL string // scheme://host[:port] that image URLs are built from
+
+	BlobStore string // "local" or "s3"
+	UploadDir string // root of the local blob store
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+
+	URLSigningKey string        // HMAC key of private image URLs, derived from the JWT key when unset
+	SignedURLTTL  time.Duration // minimum lifetime of a signed image URL
+
+	UploadGCInterval time.Duration // how often orphaned uploads are swept
+	UploadGCGrace    time.Duration // orphans younger than this are kept
+
+	ProductStates []string // accepted values of product_state
+
+	DBMaxOpenConns    int           // upper bound of connections in the shared pool
+	DBMaxIdleConns    int           // connections kept open between requests
+	DBConnMaxLifetime time.Duration // connections are recycled after this
+
+	RequestTimeout  time.Duration // deadline of an API request
+	UploadTimeout   time.Duration // deadline of a request that uploads images
+	ShutdownTimeout time.Duration // time in-flight requests get to finish on shutdown
+
+	MetricsAddr string // listener of the Prometheus /metrics endpoint, not exposed publicly
+
+	TraceExporter    string  // "none", "otlp" or "stdout"
+	TraceSampleRatio float64 // share of new traces that are recorded, 0 to 1
+
+	LogLevel  string // debug, info, warn or error
+	LogFormat string // "json" or "text"
+
+	RateLimitStore        string // "redis" or "memory"
+	AccountDeletedMailURL string
+}
+
+const (
+	EnvProduction  = "production"
+	EnvDevelopment = "development"
+)
+
+var config = loadConfig()
+
+// loadConfig defaults to production. TANAM_ENV=development serves plain HTTP, logs
+// text, keeps rate limits in memory and drops the global one, so working on the API
+// needs no certificate.
+func loadConfig() Config {
+	env := getEnv("TANAM_ENV", EnvProduction)
+	tlsMode, logFormat, rateLimitStore, publicBaseURL, globalRateLimit := TLSFiles, "json", "redis", "https://api.tanam.software:8488", 300
+	if env == EnvDevelopment {
+		tlsMode, logFormat, rateLimitStore, publicBaseURL, globalRateLimit = TLSOff, "text", "memory", "http://localhost:8081", 0
+	}
+
+	return Config{
+		Env: env,
+
+		HTTPSAddr:       getEnv("TANAM_HTTPS_ADDR", ":8488"),
+		HTTPAddr:        getEnv("TANAM_HTTP_ADDR", ":8081"),
+		TLSMode:         getEnv("TANAM_TLS", tlsMode),
+		TLSCertFile:     getEnv("TANAM_TLS_CERT_FILE", "/etc/letsencrypt/live/api.tanam.software/fullchain.pem"),
+		TLSKeyFile:      getEnv("TANAM_TLS_KEY_FILE", "/etc/letsencrypt/live/api.tanam.software/privkey.pem"),
+		ACMEDomains:     splitList(getEnv("TANAM_ACME_DOMAINS", "")),
+		ACMECacheDir:    getEnv("TANAM_ACME_CACHE_DIR", "acme-cache"),
+		ACMEEmail:       getEnv("TANAM_ACME_EMAIL", ""),
+		HSTSMaxAge:      getEnvDuration("TANAM_HSTS_MAX_AGE", 365*24*time.Hour),
+		GlobalRateLimit: getEnvInt("TANAM_GLOBAL_RATE_LIMIT", globalRateLimit),
+
+		PublicBaseURL: strings.TrimSuffix(getEnv("TANAM_PUBLIC_BASE_URL", publicBaseURL), "/"),
+
+		BlobStore: getEnv("TANAM_BLOB_STORE", "local"),
+		UploadDir: getEnv("TANAM_UPLOAD_DIR", "uploads"),
+
+		S3Endpoint:  getEnv("TANAM_S3_ENDPOINT", "localhost:9000"),
+		S3Region:    getEnv("TANAM_S3_REGION", ""),
+		S3Bucket:    getEnv("TANAM_S3_BUCKET", "tanam-uploads"),
+		S3AccessKey: getEnv("TANAM_S3_ACCESS_KEY", ""),
+		S3SecretKey: getEnv("TANAM_S3_SECRET_KEY", ""),
+		S3UseSSL:    getEnv("TANAM_S3_USE_SSL", "true") == "true",
+
+		URLSigningKey: getEnv("TANAM_URL_SIGNING_KEY", ""),
+		SignedURLTTL:  getEnvDuration("TANAM_SIGNED_URL_TTL", time.Hour),
+
+		UploadGCInterval: getEnvDuration("TANAM_UPLOAD_GC_INTERVAL", 6*time.Hour),
+		UploadGCGrace:    getEnvDuration("TANAM_UPLOAD_GC_GRACE", 24*time.Hour),
+
+		ProductStates: strings.Split(getEnv("TANAM_PRODUCT_STATES", "new,used"), ","),
+
+		DBMaxOpenConns:    getEnvInt("TANAM_DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("TANAM_DB_MAX_IDLE_CONNS", 10),
+		DBConnMaxLifetime: getEnvDuration("TANAM_DB_CONN_MAX_LIFETIME", 5*time.Minute),
+
+		RequestTimeout:  getEnvDuration("TANAM_REQUEST_TIMEOUT", 10*time.Second),
+		UploadTimeout:   getEnvDuration("TANAM_UPLOAD_TIMEOUT", time.Minute),
+		ShutdownTimeout: getEnvDuration("TANAM_SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		MetricsAddr: getEnv("TANAM_METRICS_ADDR", "localhost:9100"),
+
+		TraceExporter:    getEnv("TANAM_TRACE_EXPORTER", "none"),
+		TraceSampleRatio: getEnvFloat("TANAM_TRACE_SAMPLE_RATIO", 1),
+
+		LogLevel:  getEnv("TANAM_LOG_LEVEL", "info"),
+		LogFormat: getEnv("TANAM_LOG_FORMAT", logFormat),
+
+		RateLimitStore:        getEnv("TANAM_RATE_LIMIT_STORE", rateLimitStore),
+		AccountDeletedMailURL: getEnv("TANAM_ACCOUNT_DELETED_MAIL_URL", ""),
+	}
+}
+
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma separated value, an empty value is an empty list.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	f, err := strconv.ParseFloat(getEnv(key, ""), 64)
+	if err != nil || f < 0 {
+		return fallback
+	}
+	return f
+}
+
+func getEnvInt(key string, fallback int) int {
+	n, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
@@ -1,26 +1,73 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"net/http"
+	"sync"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
-func dbConnect(w http.ResponseWriter) (*sql.DB, error) {
-	db, err := sql.Open("mysql", "tanam:t4nAm_mariadb@tcp(tanam.software:3306)/tanam")
+const dataSourceName = "tanam:t4nAm_mariadb@tcp(tanam.software:3306)/tanam?parseTime=true"
+
+// The pool is shared by every request and opened on first use. Callers must not
+// close it, database/sql hands connections back to the pool by itself.
+var (
+	dbPool     *sql.DB
+	dbPoolOnce sync.Once
+	dbPoolErr  error
+)
+
+func sharedDB() (*sql.DB, error) {
+	dbPoolOnce.Do(func() {
+		dbPool, dbPoolErr = openTracedDB("mysql", dataSourceName)
+		if dbPoolErr != nil {
+			return
+		}
+		dbPool.SetMaxOpenConns(config.DBMaxOpenConns)
+		dbPool.SetMaxIdleConns(config.DBMaxIdleConns)
+		dbPool.SetConnMaxLifetime(config.DBConnMaxLifetime)
+		prometheus.MustRegister(collectors.NewDBStatsCollector(dbPool, "tanam"))
+	})
+	return dbPool, dbPoolErr
+}
+
+// closeDB closes the shared pool on shutdown, if it was ever opened.
+func closeDB() {
+	if dbPool != nil {
+		dbPool.Close()
+	}
+}
+
+// openDB returns the shared pool once the database answers, for callers that are
+// not serving a request (middleware, CLI commands).
+func openDB(ctx context.Context) (*sql.DB, error) {
+	db, err := sharedDB()
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "database connection failed", Data: err.Error()})
 		return nil, err
 	}
 
-	// Check if the connection is actually established
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
-		db.Close()
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "database connection ping failed", Data: err.Error()})
 		return nil, err
 	}
 
 	return db, nil
 }
+
+func dbConnect(ctx context.Context, w http.ResponseWriter) (*sql.DB, error) {
+	db, err := openDB(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, errTimeout)
+		} else {
+			writeError(w, errDatabase)
+		}
+		return nil, err
+	}
+	return db, nil
+}
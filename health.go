@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readinessCheckTimeout = 2 * time.Second
+	// Probes are public, results are reused for a while so polling them cannot turn
+	// into load on the database or writes to the blob store
+	readinessCacheTTL = 5 * time.Second
+)
+
+// dependencyCheck reports whether one dependency can serve requests right now.
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// dependencyStatus is what readyz tells about one dependency. Why a check failed is
+// only logged, errors name hosts and drivers.
+type dependencyStatus struct {
+	Status    string  `json:"status"` // "ok" or "failed"
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+var readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	statuses  map[string]dependencyStatus
+	ready     bool
+}
+
+var readinessChecks = []dependencyCheck{
+	{"database", func(ctx context.Context) error {
+		db, err := sharedDB()
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
+	}},
+	{"redis", func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}},
+	{"uploads", checkUploadsWritable},
+}
+
+// checkUploadsWritable writes and removes a probe blob. It goes below the staging
+// prefix, so the upload sweeper removes it should the delete fail.
+func checkUploadsWritable(ctx context.Context) error {
+	key := stagingPrefix + "readyz/" + newRequestID()
+	if err := blobStore.Put(ctx, key, []byte("ok"), "text/plain"); err != nil {
+		return err
+	}
+	return blobStore.Delete(ctx, key)
+}
+
+// healthz only tells that the process serves requests, it never looks at dependencies
+// so a database outage does not get every instance restarted.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "ok"})
+}
+
+// readyz runs every readiness check concurrently and answers 503 when one fails,
+// so the load balancer stops sending traffic until the dependency is back.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	statuses, ready := checkReadiness(r.Context())
+	if !ready {
+		sendJSONResponse(w, http.StatusServiceUnavailable, Response{Status: "failed", Data: statuses})
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: statuses})
+}
+
+// checkReadiness returns the cached outcome while it is fresh. Concurrent probes wait
+// for the one running the checks instead of running their own.
+func checkReadiness(ctx context.Context) (map[string]dependencyStatus, bool) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	if time.Since(readiness.checkedAt) < readinessCacheTTL {
+		return readiness.statuses, readiness.ready
+	}
+
+	// The outcome is shared, a probe that hangs up must not fail it for everyone
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+	defer cancel()
+
+	statuses := make(map[string]dependencyStatus, len(readinessChecks))
+	ready := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range readinessChecks {
+		wg.Add(1)
+		go func(c dependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			status := dependencyStatus{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				slog.WarnContext(ctx, "readiness check failed", "dependency", c.name, "err", err)
+				status.Status = "failed"
+			}
+			mu.Lock()
+			statuses[c.name] = status
+			ready = ready && err == nil
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	readiness.checkedAt, readiness.statuses, readiness.ready = time.Now(), statuses, ready
+	return statuses, ready
+}
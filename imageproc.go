@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+)
+
+// imageVariantWidths are the resized copies generated for every upload, smallest first.
+// The 200px one is the thumbnail used by the product list.
+var imageVariantWidths = []int{200, 400, 800, 1600}
+
+const jpegQuality = 85
+
+type processedImage struct {
+	Name        string
+	Width       int // of a resized variant, 0 for the full size image
+	Data        []byte
+	ContentType string
+}
+
+// variantName derives the file name of a resized copy, abc.jpg becomes abc_w400.jpg.
+func variantName(name string, width int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_w%d%s", strings.TrimSuffix(name, ext), width, ext)
+}
+
+// processUpload re-encodes a validated upload and its resized variants. Re-encoding
+// drops EXIF and every other metadata block, so the EXIF orientation is applied first.
+func processUpload(upload *validatedUpload) ([]processedImage, error) {
+	img := toRGBA(upload.Image)
+	if upload.ContentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(upload.Data))
+	}
+
+	// WebP cannot be encoded with the standard library, it is stored as JPEG or PNG instead
+	encodePNG := upload.ContentType == "image/png" || (upload.ContentType == "image/webp" && !img.Opaque())
+	ext, contentType := ".jpg", "image/jpeg"
+	if encodePNG {
+		ext, contentType = ".png", "image/png"
+	}
+
+	encode := func(img image.Image) ([]byte, error) {
+		var buf bytes.Buffer
+		var err error
+		if encodePNG {
+			err = png.Encode(&buf, img)
+		} else {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		}
+		return buf.Bytes(), err
+	}
+
+	data, err := encode(img)
+	if err != nil {
+		return nil, err
+	}
+	images := []processedImage{{Data: data, ContentType: contentType}}
+
+	// Resize from the previous, larger variant, each step stays a small downscale
+	source := img
+	for i := len(imageVariantWidths) - 1; i >= 0; i-- {
+		width := imageVariantWidths[i]
+		if width >= img.Bounds().Dx() {
+			continue
+		}
+		source = resizeImage(source, width)
+		data, err := encode(source)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, processedImage{Width: width, Data: data, ContentType: contentType})
+	}
+
+	// The name is the hash of every object stored for the upload, so changing the encoder
+	// or the resizer never stores other bytes under a name already handed out. Variants
+	// keep the name of their original, see variantName.
+	sum := sha256.New()
+	for _, processed := range images {
+		digest := sha256.Sum256(processed.Data)
+		sum.Write(digest[:])
+	}
+	base := hex.EncodeToString(sum.Sum(nil)) + ext
+	images[0].Name = base
+	for i := 1; i < len(images); i++ {
+		images[i].Name = variantName(base, images[i].Width)
+	}
+	return images, nil
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resizeImage scales src down to width keeping the aspect ratio. Every destination
+// pixel is the average of the source pixels it covers, which avoids the aliasing
+// of nearest neighbour sampling on large downscales.
+func resizeImage(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint32(row[i])
+					g += uint32(row[i+1])
+					b += uint32(row[i+2])
+					a += uint32(row[i+3])
+					n++
+				}
+			}
+			o := y*dst.Stride + x*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(b / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag (1 to 8) of a JPEG, 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		size := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if marker == 0xDA || size < 2 || pos+2+size > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img so it displays upright without the EXIF tag.
+func applyOrientation(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored and rotated 270 clockwise
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored and rotated 90 clockwise
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 270 clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], img.Pix[y*img.Stride+x*4:y*img.Stride+x*4+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Stored names have to change whenever any stored byte does, otherwise promote
+// overwrites a blob clients already cache forever.
+func TestProcessUploadNames(t *testing.T) {
+	process := func(shade uint8) []processedImage {
+		img := image.NewRGBA(image.Rect(0, 0, 500, 300))
+		for i := range img.Pix {
+			img.Pix[i] = shade
+		}
+		img.Set(10, 10, color.RGBA{R: 255, A: 255})
+		images, err := processUpload(&validatedUpload{ContentType: "image/png", Image: img})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return images
+	}
+
+	images := process(255)
+	if len(images) != 3 {
+		t.Fatalf("%d images, want the original and the 200 and 400 variants", len(images))
+	}
+	sum := sha256.New()
+	for _, processed := range images {
+		digest := sha256.Sum256(processed.Data)
+		sum.Write(digest[:])
+	}
+	base := hex.EncodeToString(sum.Sum(nil)) + ".png"
+	if images[0].Name != base {
+		t.Errorf("name %s, want %s", images[0].Name, base)
+	}
+	for _, variant := range images[1:] {
+		if variant.Name != variantName(base, variant.Width) {
+			t.Errorf("variant %d named %s", variant.Width, variant.Name)
+		}
+		if !contentAddressedName.MatchString(variant.Name) {
+			t.Errorf("variant %s does not look content addressed", variant.Name)
+		}
+	}
+
+	if again := process(255); again[0].Name != base {
+		t.Errorf("same image named %s and %s", base, again[0].Name)
+	}
+	if other := process(128); other[0].Name == base {
+		t.Error("different output stored under the same name")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestInfo travels with a request so middleware further in can fill in who made
+// it and LoggingMiddleware, which runs first, can still log it once the request is done.
+type requestInfo struct {
+	ID       string
+	UserID   string
+	APIKeyID int
+}
+
+const requestInfoContextKey contextKey = "request_info"
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// Values of these log attributes never reach the log, whatever logs them. Keys
+// containing one of redactedKeyParts are redacted as well as the exact redactedKeys.
+// "code" is the form field the TOTP handlers read, API error codes are logged as error_code.
+var (
+	redactedKeyParts = []string{"password", "token", "secret", "authorization", "cookie"}
+	redactedKeys     = map[string]bool{"otp": true, "code": true, "totp_code": true, "recovery_code": true, "sig": true, "api_key": true}
+)
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if redactedKeys[key] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	for _, part := range redactedKeyParts {
+		if strings.Contains(key, part) {
+			return slog.String(a.Key, "[REDACTED]")
+		}
+	}
+	return a
+}
+
+// contextHandler adds the request id, user and trace of the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := requestInfoFromContext(ctx); info != nil {
+		r.AddAttrs(slog.String("request_id", info.ID))
+		if info.UserID != "" {
+			r.AddAttrs(slog.String("user_id", info.UserID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func newLogger(cfg Config) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler = slog.NewJSONHandler(os.Stdout, opts)
+	if cfg.LogFormat == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+func init() {
+	slog.SetDefault(newLogger(config))
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDMiddleware keeps the X-Request-ID of a proxy in front of us, or makes one
+// up, and echoes it in the response so a client can quote it in a bug report.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestInfoContextKey, &requestInfo{ID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// LoggingMiddleware writes one access log line per request. It has to run outside
+// of everything that can answer a request, so rejected requests are logged too.
+// Only the path is logged, query strings can carry signatures.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("ip", clientIP(r)),
+		}
+		if info := requestInfoFromContext(r.Context()); info != nil && info.APIKeyID != 0 {
+			attrs = append(attrs, slog.Int("api_key_id", info.APIKeyID))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestRedactAttr(t *testing.T) {
+	// The form fields carrying credentials, as the handlers read them
+	for _, key := range []string{"user_password", "current_password", "new_password", "code", "recovery_code", "mfa_token", "api_key", "sig", "Authorization", "X-Session-Token"} {
+		if got := redactAttr(nil, slog.String(key, "value")); got.Value.String() != "[REDACTED]" {
+			t.Errorf("%s logged as %q", key, got.Value)
+		}
+	}
+	for _, key := range []string{"error_code", "user_id", "request_id", "path", "err"} {
+		if got := redactAttr(nil, slog.String(key, "value")); got.Value.String() != "value" {
+			t.Errorf("%s redacted", key)
+		}
+	}
+}
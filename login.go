@@ -6,141 +6,160 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
+
+	"tanamdev/validation"
 )
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("Parsing form error: %v\n", err)
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: err.Error()})
+		slog.WarnContext(r.Context(), "parsing form error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
 		return
 	}
 
 	email := r.FormValue("user_email")
 	password := r.FormValue("user_password")
-	fmt.Println(email)
-	fmt.Println(password)
-	if email == "" || password == "" {
-		fmt.Println("Form empty error")
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: nil})
+	v := validation.New()
+	if v.Required("user_email", email) {
+		v.Email("user_email", email)
+	}
+	v.Required("user_password", password)
+	if !v.Valid() {
+		slog.InfoContext(r.Context(), "form validation failed", "errors", v.Errors())
+		writeError(w, v.Errors())
 		return
 	}
-	err = incrementAttempts(email)
+	exceeded, err := loginAttemptsExceeded(r.Context(), email)
 	if err != nil {
-		log.Printf("Failed to increment login attempts: %v", err)
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: "Internal Server Error"})
-		// http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	attemptsKey := fmt.Sprintf("login_attempts:%s", email)
-	val, err := rdb.Get(context.Background(), attemptsKey).Result()
-	if err != nil && err != redis.Nil {
-		log.Printf("Failed to retrieve login attempts: %v", err)
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: "Internal Server Error"})
+		slog.ErrorContext(r.Context(), "failed to check login attempts", "err", err)
+		writeError(w, errInternal)
 		// http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	var attempts LoginAttempts
-	if err := json.Unmarshal([]byte(val), &attempts); err != nil {
-		attempts = LoginAttempts{} // Initialize if no previous attempts
-	}
-
 	// Check if max attempts exceeded
-	if attempts.Count >= 5 {
-		sendJSONResponse(w, http.StatusTooManyRequests, Response{Status: "failed", Data: "Maximum login attempts exceeded"})
+	if exceeded {
+		loginLockouts.WithLabelValues("password").Inc()
+		writeError(w, newAPIError(CodeRateLimited, "Maximum login attempts exceeded"))
 		// http.Error(w, "Maximum login attempts exceeded", http.StatusTooManyRequests)
 		return
 	}
 
-	db, err := dbConnect(w)
+	db, err := dbConnect(r.Context(), w)
 	if err != nil {
-		fmt.Println("dbconnect error:", err.Error())
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
 		return
 	}
-	defer db.Close()
 
-	passStmt, err := db.Prepare("SELECT user_password FROM user WHERE user_email = ?")
+	passStmt, err := db.PrepareContext(r.Context(), "SELECT user_password FROM user WHERE user_email = ?")
 	if err != nil {
-		fmt.Println("SQL Prepare password error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		slog.ErrorContext(r.Context(), "SQL Prepare password error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer passStmt.Close()
 
 	var hashedPassword string
-	err = passStmt.QueryRow(email).Scan(&hashedPassword)
+	err = passStmt.QueryRowContext(r.Context(), email).Scan(&hashedPassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			sendJSONResponse(w, http.StatusUnauthorized, Response{Status: "failed", Data: "Invalid email or password"})
+			writeError(w, errInvalidCredentials)
 			return
 		}
-		log.Println("Error fetching hashed password:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: "Database error"})
+		slog.ErrorContext(r.Context(), "error fetching hashed password", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 	if err != nil {
-		sendJSONResponse(w, http.StatusUnauthorized, Response{Status: "failed", Data: "Invalid email or password"})
+		writeError(w, errInvalidCredentials)
 		return
 	}
 
-	stmt, err := db.Prepare("SELECT user_id, user_email, user_password, user_name FROM user WHERE user_email = ? AND user_password = ?")
+	stmt, err := db.PrepareContext(r.Context(), "SELECT user_id, user_email, user_password, user_name, user_role, user_status, user_totp_enabled FROM user WHERE user_email = ? AND user_password = ?")
 	if err != nil {
-		fmt.Println("SQL Prepare error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		slog.ErrorContext(r.Context(), "SQL Prepare error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(email, hashedPassword)
+	rows, err := stmt.QueryContext(r.Context(), email, hashedPassword)
 	if err != nil {
-		fmt.Println("SQL Query error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		slog.ErrorContext(r.Context(), "SQL Query error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		sendJSONResponse(w, http.StatusUnauthorized, Response{Status: "failed", Data: "user not found"})
+		writeError(w, errInvalidCredentials)
 		return
 	}
 
 	var fetchedUser User
-	err = rows.Scan(&fetchedUser.ID, &fetchedUser.Email, &fetchedUser.Password, &fetchedUser.Name)
+	var status string
+	var totpEnabled bool
+	err = rows.Scan(&fetchedUser.ID, &fetchedUser.Email, &fetchedUser.Password, &fetchedUser.Name, &fetchedUser.Role, &status, &totpEnabled)
 	if err != nil {
-		fmt.Println("Fetching error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		slog.ErrorContext(r.Context(), "fetching error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 
-	resetAttempts(email)
+	if status == UserStatusBanned {
+		writeError(w, errAccountBanned)
+		return
+	}
 
-	tokenString, expirationTime, err := createToken(email, 5*time.Minute)
-	if err != nil {
-		fmt.Println("Create access token error:", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// With 2FA on, the password only earns a short lived token for loginTOTPHandler.
+	// Attempts are not reset yet so wrong codes keep counting towards the lockout.
+	if totpEnabled {
+		mfaToken, _, err := createMFAToken(fetchedUser)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "create mfa token error", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, Response{Status: "mfa_required", Data: map[string]string{"mfa_token": mfaToken}})
 		return
 	}
 
-	refreshTokenString, refreshExpirationTime, err := createToken(email, 7*24*time.Hour)
-	if err != nil {
-		fmt.Println("Create refresh token error:", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	resetAttempts(r.Context(), email)
+
+	if err := issueSession(w, fetchedUser); err != nil {
+		slog.ErrorContext(r.Context(), "create token error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: fetchedUser})
+}
+
+// issueSession sets the access and refresh token cookies for a fully authenticated user.
+func issueSession(w http.ResponseWriter, user User) error {
+	tokenString, expirationTime, err := createToken(user, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	refreshTokenString, refreshExpirationTime, err := createToken(user, 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:    "access_token",
 		Value:   tokenString,
@@ -153,13 +172,32 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		Expires:  refreshExpirationTime,
 		HttpOnly: true,
 	})
+	return nil
+}
 
-	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: fetchedUser})
+// loginAttemptsExceeded counts one more attempt for email and reports whether it is locked out.
+func loginAttemptsExceeded(ctx context.Context, email string) (bool, error) {
+	err := incrementAttempts(ctx, email)
+	if err != nil {
+		return false, err
+	}
+
+	attemptsKey := fmt.Sprintf("login_attempts:%s", email)
+	val, err := rdb.Get(ctx, attemptsKey).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	var attempts LoginAttempts
+	if err := json.Unmarshal([]byte(val), &attempts); err != nil {
+		attempts = LoginAttempts{} // Initialize if no previous attempts
+	}
+	return attempts.Count >= 5, nil
 }
 
-func incrementAttempts(email string) error {
+func incrementAttempts(ctx context.Context, email string) error {
 	attemptsKey := fmt.Sprintf("login_attempts:%s", email)
-	val, err := rdb.Get(context.Background(), attemptsKey).Result()
+	val, err := rdb.Get(ctx, attemptsKey).Result()
 	if err != nil && err != redis.Nil {
 		return err
 	}
@@ -178,22 +216,24 @@ func incrementAttempts(email string) error {
 		return err
 	}
 
-	return rdb.Set(context.Background(), attemptsKey, string(data), 10*time.Minute).Err()
+	return rdb.Set(ctx, attemptsKey, string(data), 10*time.Minute).Err()
 }
 
-func resetAttempts(email string) {
+func resetAttempts(ctx context.Context, email string) {
 	attemptsKey := fmt.Sprintf("login_attempts:%s", email)
-	err := rdb.Del(context.Background(), attemptsKey).Err()
+	err := rdb.Del(ctx, attemptsKey).Err()
 	if err != nil {
-		log.Printf("Failed to delete attempts for userID %s: %v", email, err)
+		slog.Error("failed to delete login attempts", "err", err)
 		// Handle the error as needed (logging, retrying, etc.)
 	}
 }
 
-func createToken(email string, duration time.Duration) (string, time.Time, error) {
+func createToken(user User, duration time.Duration) (string, time.Time, error) {
 	expirationTime := time.Now().Add(duration)
 	claims := &Claims{
-		Email: email,
+		Email:  user.Email,
+		UserID: user.ID,
+		Role:   user.Role,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
 			IssuedAt:  time.Now().Unix(),
@@ -210,10 +250,10 @@ func refreshHandler(w http.ResponseWriter, r *http.Request) {
 	c, err := r.Cookie("refresh_token")
 	if err != nil {
 		if err == http.ErrNoCookie {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, errUnauthorized)
 			return
 		}
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, errUnauthorized)
 		return
 	}
 
@@ -225,27 +265,56 @@ func refreshHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, errUnauthorized)
 			return
 		}
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, errUnauthorized)
 		return
 	}
 
-	if !tkn.Valid {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !tkn.Valid || claims.Purpose != "" {
+		writeError(w, errUnauthorized)
+		return
+	}
+
+	if sessionRevoked(r.Context(), claims) {
+		writeError(w, newAPIError(CodeUnauthorized, "Session revoked"))
 		return
 	}
 
 	// Check if the refresh token is expired
 	if time.Unix(claims.ExpiresAt, 0).Before(time.Now()) {
-		http.Error(w, "Unauthorized - Refresh token expired", http.StatusUnauthorized)
+		writeError(w, newAPIError(CodeUnauthorized, "Refresh token expired"))
+		return
+	}
+
+	// Roles and bans can change while a refresh token is alive, so read them again.
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var user User
+	var status string
+	err = db.QueryRowContext(r.Context(), "SELECT user_id, user_email, user_role, user_status FROM user WHERE user_email = ?", claims.Email).Scan(&user.ID, &user.Email, &user.Role, &status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errUnauthorized)
+			return
+		}
+		slog.ErrorContext(r.Context(), "fetching user error", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if status == UserStatusBanned {
+		writeError(w, errAccountBanned)
 		return
 	}
 
-	tokenString, accessExpirationTime, err := createToken(claims.Email, 5*time.Minute)
+	tokenString, accessExpirationTime, err := createToken(user, 5*time.Minute)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, internalError(err))
 		return
 	}
 	//set cookie for access token
@@ -263,22 +332,24 @@ func forgotPassword(w http.ResponseWriter, r *http.Request) {
 	var req map[string]string
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		log.Printf("Parsing json error: %v\n", err)
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: err.Error()})
+		slog.WarnContext(r.Context(), "parsing json error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
 		return
 	}
 
 	email := req["user_email"]
 	if email == "" {
-		fmt.Println("json empty error")
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: nil})
+		writeError(w, errInvalidForm)
 		return
 	}
-	fmt.Println(email)
 
+	// Limit per target address too, so rotating IPs cannot be used to flood one inbox
+	limit, err := rateLimiter.Allow(r.Context(), "forgotpassword_email:"+strings.ToLower(email), PerHour(3))
 	if err != nil {
-		fmt.Println("Encryption error:", err)
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "error", Data: err.Error()})
+		slog.ErrorContext(r.Context(), "rate limiter error", "err", err)
+	} else if !limit.Allowed {
+		writeRateLimitHeaders(w, limit)
+		writeError(w, newAPIError(CodeRateLimited, "Too many reset requests for this email"))
 		return
 	}
 
@@ -289,26 +360,28 @@ func forgotPassword(w http.ResponseWriter, r *http.Request) {
 
 	jsonPayload, err := json.Marshal(payload) //same like stringify
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.ErrorContext(r.Context(), "failed to encode mail payload", "err", err)
 		return
 	}
-	log.Println("Payload to be sent:", string(jsonPayload))
 	resp, err := http.Post("https://script.google.com/macros/s/AKfycbwr6PYtoMC5idZeuaVqWSq0ScPB5-htIYmAuhlzDOz7cydA8MW0rBwLf3d29-LL8hzH/exec", "application/json", bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		fmt.Println("Error:", err)
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "error", Data: err.Error()})
+		slog.ErrorContext(r.Context(), "failed to send mail", "err", err)
+		countEmail("reset", err)
+		writeError(w, errMailFailed)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Error: Failed to send data to the API")
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "error", Data: resp.StatusCode})
+		slog.ErrorContext(r.Context(), "mail api failed", "status", resp.StatusCode)
+		countEmail("reset", errMailFailed)
+		writeError(w, errMailFailed)
 		return
 	}
+	countEmail("reset", nil)
 	sendJSONResponse(w, http.StatusOK, Response{
 		Status: "success",
 		Data:   nil,
 	})
-	fmt.Println("Email sent successfully")
+	slog.InfoContext(r.Context(), "email sent")
 }
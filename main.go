@@ -2,10 +2,15 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,6 +22,7 @@ type Response struct {
 	TotalPages int         `json:"totalPage,omitempty"` // Optional field
 	Status     string      `json:"status"`
 	Data       interface{} `json:"data"`
+	Error      *APIError   `json:"error,omitempty"` // only on failed requests, see writeError
 }
 
 type CachedResponse struct {
@@ -28,11 +34,12 @@ type User struct {
 	ID       string `json:"user_id"`
 	Name     string `json:"user_name"`
 	Email    string `json:"user_email"`
-	Password string `json:"user_password"`
+	Password string `json:"-"` // bcrypt hash, never sent to clients
 	Gender   string `json:"User_gender"`
-	Phone    int    `json:"user_phone"`
+	Phone    string `json:"user_phone"` // E.164, e.g. +6281234567890
 	Address  string `json:"user_address"`
 	Photo    string `json:"user_photo"`
+	Role     string `json:"user_role"`
 }
 
 type RequestParams struct {
@@ -43,15 +50,16 @@ type RequestParams struct {
 }
 
 type Product struct {
-	ProductID          int    `json:"product_id"`
-	ProductName        string `json:"product_name"`
-	ProductCategory    string `json:"product_category"`
-	ProductPrice       string `json:"product_price"` //if it is set tp float64, dart sometimes read it as int or double, if no decimal, so int, if decimal so double
-	ProductQuantity    int    `json:"product_quantity"`
-	ProductState       string `json:"product_state"`
-	ProductDescription string `json:"product_description"`
-	SellerID           int    `json:"seller_id"`
-	ProductImageUrl    string `json:"product_image_url"`
+	ProductID          int            `json:"product_id"`
+	ProductName        string         `json:"product_name"`
+	ProductCategory    string         `json:"product_category"`
+	ProductPrice       string         `json:"product_price"` //if it is set tp float64, dart sometimes read it as int or double, if no decimal, so int, if decimal so double
+	ProductQuantity    int            `json:"product_quantity"`
+	ProductState       string         `json:"product_state"`
+	ProductDescription string         `json:"product_description"`
+	SellerID           int            `json:"seller_id"`
+	ProductImageUrl    string         `json:"product_image_url"` // primary image, the first of Images, kept for older clients
+	Images             []ProductImage `json:"images"`
 }
 
 type Category struct {
@@ -60,7 +68,12 @@ type Category struct {
 }
 
 type Claims struct {
-	Email string `json:"email"`
+	Email  string `json:"email"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	// Purpose is empty for session tokens, purpose tokens such as the 2FA pending one
+	// must never be accepted where a session is expected.
+	Purpose string `json:"purpose,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -76,115 +89,106 @@ type LoginAttempts struct {
 
 var jwtKey = []byte("tanam_api_key")
 
-var tanamApiKey = []byte("tanam_api_key")
-
 var rdb = redis.NewClient(&redis.Options{
 	Addr:     "localhost:6379",
 	Password: "",
 	DB:       0,
 })
 
-func main() {
-	httpsMux := http.NewServeMux()
-	httpsMux.HandleFunc("/api/tanam/login", loginHandler)
-	httpsMux.HandleFunc("/login", loginHandler)
-	httpsMux.HandleFunc("/register", createUser)
-	// httpsMux.HandleFunc("/upload", IsAuthorized(uploadFile))
-	// httpsMux.HandleFunc("/uploads/", serveImage)
-	// httpsMux.HandleFunc("/cart", IsAuthorized(serveImage))
-	httpsMux.HandleFunc("/refresh", refreshHandler)
-	httpsMux.HandleFunc("/getProduct", getProduct)
-	// httpsMux.HandleFunc("/getCategory", getCategory)
-
-	fmt.Println("Starting HTTP server on port 8081 for redirection to HTTPS")
-	if err := http.ListenAndServe(":8081", httpsMux); err != nil {
-		log.Fatalf("HTTP server failed to start: %v", err)
-	}
+// commands are the subcommands of the binary, serve runs when none is given.
+var commands = map[string]struct {
+	run   func(args []string)
+	usage string
+}{
+	"serve":        {runServeCommand, "run the API"},
+	"migrate":      {runMigrateCommand, "apply pending database migrations"},
+	"seed":         {runSeedCommand, "insert development users and products"},
+	"create-admin": {runCreateAdminCommand, "create an admin account or promote an existing user"},
+	"apikey":       {runAPIKeyCommand, "create an API key"},
+	"gc-uploads":   {runUploadGCCommand, "remove orphaned uploads"},
 }
 
-func main2() {
-	httpsMux := http.NewServeMux()
-
-	registerMidHandler := ChainMiddleware(http.HandlerFunc(createUser), LoggingMiddleware, APIKeyMiddleware, GzipMiddleware)
-	httpsMux.Handle("/api/tanam/register", registerMidHandler)
-
-	loginMidHandler := ChainMiddleware(
-		http.HandlerFunc(loginHandler),
-		LoggingMiddleware,
-		// MaxLoginAttemptsMiddleware,
-		APIKeyMiddleware,
-		GzipMiddleware,
-	)
-	httpsMux.Handle("/api/tanam/login", loginMidHandler)
-	httpsMux.HandleFunc("/api/tanam/login2", loginHandler)
-	httpsMux.HandleFunc("/login", loginHandler)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].usage)
+	}
+}
 
-	insertProductMidHandler := ChainMiddleware(http.HandlerFunc(insertProduct), LoggingMiddleware, APIKeyMiddleware, JWTMiddleware, GzipMiddleware)
-	httpsMux.Handle("/api/tanam/insertproduct", insertProductMidHandler)
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
 
-	getProductMidHandler := ChainMiddleware(http.HandlerFunc(getProduct), LoggingMiddleware, APIKeyMiddleware, GzipMiddleware)
-	httpsMux.Handle("/api/tanam/getproduct", getProductMidHandler)
+	store, err := newBlobStore(config)
+	if err != nil {
+		log.Fatalf("Blob store setup failed: %v", err)
+	}
+	blobStore = store
 
-	loadImageMidHandler := ChainMiddleware(http.HandlerFunc(loadImage), LoggingMiddleware)
-	httpsMux.Handle("/api/tanam/loadimage/", loadImageMidHandler)
+	cmd.run(args)
+}
 
-	forgotMidHandler := ChainMiddleware(http.HandlerFunc(forgotPassword), LoggingMiddleware, APIKeyMiddleware, GzipMiddleware)
-	httpsMux.Handle("/api/tanam/forgotpassword", forgotMidHandler)
+// runServeCommand serves the API over TLS with a redirect from plain HTTP, or only
+// over plain HTTP when TLS is off, plus the metrics listener.
+func runServeCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Parse(args)
 
-	refreshMidHandler := ChainMiddleware(http.HandlerFunc(refreshHandler), LoggingMiddleware, APIKeyMiddleware, GzipMiddleware)
-	httpsMux.Handle("/api/tanam/refresh", refreshMidHandler)
+	shutdownTracing, err := setupTracing(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Tracing setup failed: %v", err)
+	}
 
-	certFile := "/etc/letsencrypt/live/api.tanam.software/fullchain.pem"
-	keyFile := "/etc/letsencrypt/live/api.tanam.software/privkey.pem"
+	apiHandler := newAPIHandler(apiRoutes(), config)
 
-	go func() {
-		fmt.Println("Starting HTTPS server on port 8488")
-		err := http.ListenAndServeTLS(":8488", certFile, keyFile, httpsMux)
+	var servers []managedServer
+	if config.TLSMode == TLSOff {
+		servers = append(servers, plainServer(newServer(config.HTTPAddr, apiHandler)))
+	} else {
+		tlsConfig, httpHandler, err := newTLSConfig(config)
 		if err != nil {
-			log.Fatalf("HTTPS server failed to start: %v", err)
+			log.Fatalf("TLS setup failed: %v", err)
 		}
-	}()
-
-	httpMux := http.NewServeMux()
-	// httpMux.HandleFunc("/", redirect)
-	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		host := strings.Split(r.Host, ":")[0]
-		fmt.Println(host)
-		fmt.Println(r.RequestURI)
-		http.Redirect(w, r, "https://"+host+":8488"+r.RequestURI, http.StatusTemporaryRedirect)
+		httpsServer := newServer(config.HTTPSAddr, apiHandler)
+		httpsServer.TLSConfig = tlsConfig
+		servers = append(servers, tlsServer(httpsServer), plainServer(newServer(config.HTTPAddr, httpHandler)))
+	}
+	servers = append(servers, plainServer(newMetricsServer(config.MetricsAddr)))
+
+	slog.Info("serving", "env", config.Env, "tls", config.TLSMode)
+	err = serveUntilSignal(servers, func(ctx context.Context) {
+		startUploadGC(ctx, config.UploadGCInterval, config.UploadGCGrace)
 	})
-	// When you perform a redirect in Go using http.Redirect,
-	//  the default behavior is to redirect with a GET request.
-	// This is part of the HTTP specification where redirects typically use GET requests to navigate to the new location.
-	//Use 307 Temporary Redirect dont use 301 http.StatusMovedPermanently
-	// HTTP status code 307 (Temporary Redirect) can be used to indicate that the request should be repeated with the same HTTP method.
-	// In your Go code, you can set this status code explicitly:
-	fmt.Println("Starting HTTP server on port 8081 for redirection to HTTPS")
-	err := http.ListenAndServe(":8081", httpMux)
+
+	// Flush the spans of the last requests
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("failed to flush traces", "err", err)
+	}
 	if err != nil {
-		log.Fatalf("HTTP server failed to start: %v", err)
+		log.Fatalf("Server failed: %v", err)
 	}
 }
 
-// func redirect(w http.ResponseWriter, r *http.Request) {
-// 	host := strings.Split(r.Host, ":")[0]
-// 	http.Redirect(w, r, "https://"+host+":8488"+r.RequestURI, http.StatusMovedPermanently)
-// }
-
 func sendJSONResponse(w http.ResponseWriter, status int, responseData interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(responseData)
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("method=%s uri=%s duration=%s", r.Method, r.RequestURI, time.Since(start))
-	})
-}
-
 func GzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
@@ -202,29 +206,16 @@ func GzipMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func APIKeyMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check for API key in the request headers
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != string(tanamApiKey) {
-			fmt.Println("API key Unauthorized")
-			http.Error(w, "Forbidden: Invalid API Key", http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := r.Cookie("access_token")
 		if err != nil {
 			if err == http.ErrNoCookie {
-				fmt.Println("JWT Unauthorized", err.Error())
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				slog.Warn("JWT Unauthorized", "err", err)
+				writeError(w, errUnauthorized)
 				return
 			}
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			writeError(w, errUnauthorized)
 			return
 		}
 		tokenStr := c.Value
@@ -235,21 +226,29 @@ func JWTMiddleware(next http.Handler) http.Handler {
 
 		if err != nil {
 			if err == jwt.ErrSignatureInvalid {
-				fmt.Println("JWT Unauthorized", err.Error())
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				slog.Warn("JWT Unauthorized", "err", err)
+				writeError(w, errUnauthorized)
 				return
 			}
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			writeError(w, errUnauthorized)
 			return
 		}
 
-		if !tkn.Valid {
-			fmt.Println("Token not valid")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !tkn.Valid || claims.Purpose != "" {
+			writeError(w, errUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		if sessionRevoked(r.Context(), claims) {
+			writeError(w, errUnauthorized)
+			return
+		}
+
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.UserID = claims.UserID
+		}
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
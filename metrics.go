@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tanam_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	httpRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tanam_http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+
+	productCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tanam_product_cache_requests_total",
+		Help: "getProduct cache lookups by result (hit, miss or error).",
+	}, []string{"result"})
+
+	loginLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tanam_login_lockouts_total",
+		Help: "Login attempts rejected because the account is locked out, by login step.",
+	}, []string{"step"})
+
+	emailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tanam_emails_sent_total",
+		Help: "Emails handed to the mail scripts by kind and result (sent or failed).",
+	}, []string{"kind", "result"})
+)
+
+func countEmail(kind string, err error) {
+	result := "sent"
+	if err != nil {
+		result = "failed"
+	}
+	emailsSent.WithLabelValues(kind, result).Inc()
+}
+
+// Any other method is counted as OTHER so clients cannot grow the label set.
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// MetricsMiddleware records the latency of every request under the mux pattern that
+// serves it rather than the raw path, so ids in paths do not become label values.
+func MetricsMiddleware(mux *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			httpRequestsInFlight.Inc()
+			defer httpRequestsInFlight.Dec()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			route := routePattern(mux, r)
+			method := r.Method
+			if !metricMethods[method] {
+				method = "OTHER"
+			}
+			httpRequestDuration.WithLabelValues(route, method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// newMetricsServer serves /metrics on its own listener, so it stays off the
+// public port and needs neither an API key nor TLS.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return newServer(addr, mux)
+}
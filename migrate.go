@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"sort"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// The migrations were applied by hand before this table existed. They are written
+// to be idempotent, so the first migrate run on such a database only records them.
+const createMigrationTable = `CREATE TABLE IF NOT EXISTS schema_migration (
+	schema_migration_name VARCHAR(100) PRIMARY KEY,
+	schema_migration_applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// pendingMigrations returns the embedded migrations not recorded as applied, in order.
+func pendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	if _, err := db.ExecContext(ctx, createMigrationTable); err != nil {
+		return nil, err
+	}
+
+	applied := map[string]bool{}
+	rows, err := db.QueryContext(ctx, "SELECT schema_migration_name FROM schema_migration")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var pending []string
+	for _, name := range names {
+		if !applied[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
+
+// applyMigration runs one file and records it. MariaDB commits DDL implicitly, so a
+// file that fails halfway is not rolled back and must be fixed by hand.
+func applyMigration(ctx context.Context, db *sql.DB, name string) error {
+	script, err := migrationFiles.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO schema_migration (schema_migration_name) VALUES (?)", name)
+	return err
+}
+
+func runMigrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list pending migrations")
+	flags.Parse(args)
+
+	// Migration files hold several statements, which the shared pool does not allow
+	db, err := sql.Open("mysql", dataSourceName+"&multiStatements=true")
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	pending, err := pendingMigrations(ctx, db)
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("Database is up to date")
+		return
+	}
+
+	for _, name := range pending {
+		if *dryRun {
+			fmt.Printf("pending %s\n", name)
+			continue
+		}
+		if err := applyMigration(ctx, db, name); err != nil {
+			log.Fatalf("migrate: %s: %v", name, err)
+		}
+		slog.Info("migration applied", "name", name)
+	}
+}
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS api_key (
+	api_key_id INT AUTO_INCREMENT PRIMARY KEY,
+	api_key_name VARCHAR(100) NOT NULL,
+	api_key_owner VARCHAR(100) NOT NULL,
+	api_key_prefix CHAR(8) NOT NULL UNIQUE,
+	api_key_hash CHAR(64) NOT NULL,
+	api_key_scopes VARCHAR(255) NOT NULL DEFAULT '',
+	api_key_rate_limit INT NOT NULL DEFAULT 0,
+	api_key_created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	api_key_expires_at DATETIME NULL,
+	api_key_last_used_at DATETIME NULL,
+	api_key_revoked_at DATETIME NULL
+);
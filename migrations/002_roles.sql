@@ -0,0 +1,10 @@
+ALTER TABLE user
+	ADD COLUMN IF NOT EXISTS user_role ENUM('buyer', 'seller', 'admin') NOT NULL DEFAULT 'buyer',
+	ADD COLUMN IF NOT EXISTS user_status ENUM('active', 'banned') NOT NULL DEFAULT 'active';
+
+ALTER TABLE product
+	ADD COLUMN IF NOT EXISTS product_status ENUM('active', 'hidden', 'removed') NOT NULL DEFAULT 'active';
+
+-- Everyone starts out as a buyer, users who already list products are sellers
+UPDATE user SET user_role = 'seller'
+	WHERE user_role = 'buyer' AND user_id IN (SELECT DISTINCT seller_id FROM product);
@@ -0,0 +1,11 @@
+ALTER TABLE user
+	ADD COLUMN IF NOT EXISTS user_totp_secret VARCHAR(64) NULL,
+	ADD COLUMN IF NOT EXISTS user_totp_enabled TINYINT(1) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_recovery_code (
+	recovery_code_id INT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	recovery_code_hash CHAR(64) NOT NULL,
+	recovery_code_used_at DATETIME NULL,
+	INDEX (user_id, recovery_code_hash)
+);
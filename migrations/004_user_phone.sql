@@ -0,0 +1,6 @@
+-- Phone numbers are stored as E.164 strings, an INT loses the leading + and overflows
+ALTER TABLE user MODIFY COLUMN user_phone VARCHAR(16) NULL;
+
+-- The INT column dropped the leading +, numbers that cannot be E.164 become NULL
+UPDATE user SET user_phone = CONCAT('+', user_phone) WHERE user_phone REGEXP '^[1-9][0-9]{1,14}$';
+UPDATE user SET user_phone = NULL WHERE user_phone NOT REGEXP '^[+][1-9][0-9]{1,14}$';
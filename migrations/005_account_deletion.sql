@@ -0,0 +1,5 @@
+ALTER TABLE user
+	MODIFY COLUMN user_status ENUM('active', 'banned', 'deleted') NOT NULL DEFAULT 'active';
+
+ALTER TABLE product
+	MODIFY COLUMN product_status ENUM('active', 'hidden', 'removed', 'deleted') NOT NULL DEFAULT 'active';
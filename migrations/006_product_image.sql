@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS product_image (
+	product_image_id INT AUTO_INCREMENT PRIMARY KEY,
+	product_id INT NOT NULL,
+	product_image_url VARCHAR(255) NOT NULL,
+	product_image_order INT NOT NULL DEFAULT 0,
+	INDEX (product_id, product_image_order)
+);
+
+-- Existing products keep their single image as the primary one
+INSERT INTO product_image (product_id, product_image_url, product_image_order)
+SELECT p.product_id, p.product_image_url, 0
+FROM product p
+WHERE p.product_image_url <> ''
+	AND NOT EXISTS (SELECT 1 FROM product_image i WHERE i.product_id = p.product_id);
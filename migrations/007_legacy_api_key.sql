@@ -0,0 +1,4 @@
+-- Shipped app versions send the old shared key. It gets a row of its own so it keeps
+-- working for a transition period and can be revoked early once clients updated.
+INSERT IGNORE INTO api_key (api_key_name, api_key_owner, api_key_prefix, api_key_hash, api_key_scopes, api_key_rate_limit, api_key_expires_at)
+	VALUES ('legacy-shared-key', 'mobile-app', 'legacy00', SHA2('tanam_api_key', 256), 'app', 0, DATE_ADD(NOW(), INTERVAL 90 DAY));
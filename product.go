@@ -2,37 +2,52 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math"
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"tanamdev/validation"
+)
+
+const (
+	maxProductNameLength        = 100
+	maxProductCategoryLength    = 50
+	maxProductDescriptionLength = 2000
+	maxProductPrice             = 1e12
+	maxProductQuantity          = 1000000
 )
 
+const productColumns = "product_id, product_name, product_category, product_price, product_quantity, product_state, product_description, seller_id, product_image_url"
+
 func insertProduct(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		log.Printf("Headers: %v\n", r.Header)
-		log.Printf("Error parsing multipart form: %v\n", err)
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: err.Error()})
-		return
-	}
-
-	product_image, handler, err := r.FormFile("product_image")
-	if err != nil {
-		log.Printf("Error retrieving the image file: %v\n", err)
-		http.Error(w, "Error retrieving the image file", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "error parsing multipart form", "err", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, errUploadTooLarge)
+			return
+		}
+		writeError(w, errInvalidForm)
 		return
 	}
-	defer product_image.Close()
+	// Middleware passes a copy of the request down and net/http only removes the
+	// temporary files of the original one
+	defer r.MultipartForm.RemoveAll()
 
 	product_name := r.FormValue("product_name")
 	product_category := r.FormValue("product_category")
@@ -42,142 +57,159 @@ func insertProduct(w http.ResponseWriter, r *http.Request) {
 	product_description := r.FormValue("product_description")
 	seller_id := r.FormValue("seller_id")
 
-	price, err := strconv.ParseFloat(product_price, 64)
-	if err != nil {
-		http.Error(w, "Invalid product price", http.StatusBadRequest)
-		return
+	// Everything in the form is checked before any image is written to storage
+	v := validation.New()
+	if v.Required("product_name", product_name) {
+		v.Length("product_name", product_name, 1, maxProductNameLength)
 	}
-	quantity, err := strconv.Atoi(product_quantity)
-	if err != nil {
-		http.Error(w, "Invalid product quantity", http.StatusBadRequest)
-		return
+	if v.Required("product_category", product_category) {
+		v.Length("product_category", product_category, 1, maxProductCategoryLength)
 	}
-	fmt.Println(product_name)
-	fmt.Println(product_category)
-	fmt.Println(product_price)
-	fmt.Println(price)
-	fmt.Println(product_quantity)
-	fmt.Println(quantity)
-	fmt.Println(product_state)
-	fmt.Println(product_description)
-	fmt.Println(seller_id)
-
-	if product_name == "" || product_category == "" || product_price == "" || product_quantity == "" || product_state == "" || product_description == "" || seller_id == "" {
-		fmt.Println("Form empty error")
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: nil})
-		return
+	var price float64
+	if v.Required("product_price", product_price) {
+		price = v.Float("product_price", product_price, 0, maxProductPrice)
 	}
-
-	fileExtension := filepath.Ext(handler.Filename)
-	if fileExtension == "" {
-		log.Printf("Image file extension error")
-		http.Error(w, "Image File extension is missing", http.StatusBadRequest)
-		return
+	var quantity int
+	if v.Required("product_quantity", product_quantity) {
+		quantity = v.Int("product_quantity", product_quantity, 0, maxProductQuantity)
 	}
-
-	err = os.MkdirAll("uploads", os.ModePerm)
-	if err != nil {
-		log.Printf("Error creating 'catches' directory: %v\n", err)
-		http.Error(w, "Failed to create 'catches' directory", http.StatusInternalServerError)
+	if v.Required("product_state", product_state) {
+		v.OneOf("product_state", product_state, config.ProductStates...)
+	}
+	if v.Required("product_description", product_description) {
+		v.Length("product_description", product_description, 1, maxProductDescriptionLength)
+	}
+	if v.Required("seller_id", seller_id) {
+		v.Int("seller_id", seller_id, 1, math.MaxInt32)
+	}
+	if !v.Valid() {
+		slog.InfoContext(r.Context(), "form validation failed", "errors", v.Errors())
+		writeError(w, v.Errors())
 		return
 	}
+	slog.DebugContext(r.Context(), "insert product", "name", product_name, "category", product_category, "price", price, "quantity", quantity, "seller_id", seller_id)
 
-	newFileName := fmt.Sprintf("%s%d%s", product_name, time.Now().UnixNano(), fileExtension)
-	newFileName = filepath.Base(newFileName)
-	destinationPath := filepath.Join("uploads", newFileName)
-	url := fmt.Sprintf("https://api.tanam.software:8488/api/tanam/loadimage/%s", destinationPath)
-
-	newFile, err := os.Create(destinationPath)
-	if err != nil {
-		log.Printf("Error creating the new file indestination path: %v\n", err)
-		http.Error(w, "Error creating the file in destination path", http.StatusInternalServerError)
+	// Sellers can only list products under their own id
+	if claims, ok := claimsFromContext(r.Context()); ok && claims.Role != RoleAdmin && claims.UserID != seller_id {
+		writeError(w, newAPIError(CodeForbidden, "seller_id does not match the logged in user"))
 		return
 	}
-	defer newFile.Close()
 
-	_, err = io.Copy(newFile, product_image)
-	if err != nil {
-		log.Printf("Error copying the file: %v\n", err)
-		http.Error(w, "Error copying the file", http.StatusInternalServerError)
+	// Several product_image parts may be sent, the first one becomes the primary image
+	uploads := r.MultipartForm.File["product_image"]
+	if err := checkUploads(uploads); err != nil {
+		slog.ErrorContext(r.Context(), "image validation error", "err", err)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("File uploaded successfully: %s\n", newFileName)
-	db, err := dbConnect(w)
+	db, err := dbConnect(r.Context(), w)
 	if err != nil {
 		return
 	}
 
-	stmt, err := db.Prepare("INSERT INTO product (product_name, product_category, product_price, product_quantity, product_state, product_description, seller_id, product_image_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	staged, err := stageUploads(r.Context(), uploads)
 	if err != nil {
-		log.Printf("Error preparing SQL statement: %v\n", err)
-		http.Error(w, "Error preparing SQL statement", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	defer stmt.Close()
+	urls := stagedURLs(staged)
 
-	_, err = stmt.Exec(product_name, product_category, price, quantity, product_state, product_description, seller_id, url)
+	err = insertWithUploads(r.Context(), db, staged, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(r.Context(), "INSERT INTO product (product_name, product_category, product_price, product_quantity, product_state, product_description, seller_id, product_image_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			product_name, product_category, price, quantity, product_state, product_description, seller_id, urls[0])
+		if err != nil {
+			return err
+		}
+		productID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return insertProductImages(r.Context(), tx, productID, urls, 0)
+	})
 	if err != nil {
-		log.Printf("Error executing SQL statement: %v\n", err)
-		http.Error(w, "Error executing SQL statement", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "error executing SQL statement", "err", err)
+		writeError(w, errInternal)
 		return
 	}
+	invalidateProductCache(r.Context())
 	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Product Inserted"})
 }
 
-func getProduct(w http.ResponseWriter, r *http.Request) {
+// productListParams reads the filters of a product listing from the query string,
+// or from a JSON body as the legacy getproduct path took them.
+func productListParams(r *http.Request) (RequestParams, error) {
 	var params RequestParams
-	err := json.NewDecoder(r.Body).Decode(&params)
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&params)
+		return params, err
+	}
+	query := r.URL.Query()
+	params.UserID = query.Get("user_id")
+	params.SearchKey = query.Get("search_key")
+	params.ProductCategory = query.Get("product_category")
+	if page := query.Get("current_page"); page != "" {
+		var err error
+		if params.CurrentPage, err = strconv.Atoi(page); err != nil {
+			return params, err
+		}
+	}
+	return params, nil
+}
+
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	params, err := productListParams(r)
 	if err != nil {
-		fmt.Println("Failed to parse request body", err.Error())
-		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "failed to parse product filters", "err", err)
+		writeError(w, newAPIError(CodeBadRequest, "Failed to parse request parameters"))
 		return
 	}
 
-	conditions := ""
-	args := []interface{}{}
+	// Hidden or removed products are never listed
+	conditions := " WHERE product_status = ?"
+	args := []interface{}{ProductStatusActive}
 
 	if params.UserID != "" {
-		conditions += " WHERE seller_id = ?"
+		conditions += " AND seller_id = ?"
 		args = append(args, params.UserID)
 	} else if params.SearchKey != "" {
-		conditions += " WHERE product_name LIKE ?"
+		conditions += " AND product_name LIKE ?"
 		args = append(args, "%"+params.SearchKey+"%")
 	} else if params.ProductCategory != "" {
 		if params.ProductCategory == "For You" {
 			// No additional condition
 		} else {
-			conditions += " WHERE product_category LIKE ?"
+			conditions += " AND product_category LIKE ?"
 			args = append(args, "%"+params.ProductCategory+"%")
 		}
 	}
 
 	cacheKey := fmt.Sprintf("products:%s:%s:%s:%d", params.UserID, params.SearchKey, params.ProductCategory, params.CurrentPage)
-	ctx := context.Background()
+	ctx := r.Context()
 
 	cachedProducts, err := rdb.Get(ctx, cacheKey).Result()
 	if err == redis.Nil {
 		// Cache miss, query the database
-		db, err := dbConnect(w)
+		productCacheRequests.WithLabelValues("miss").Inc()
+		db, err := dbConnect(r.Context(), w)
 		if err != nil {
-			fmt.Println("dbconnect error:", err.Error())
+			slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
 			return
 		}
-		defer db.Close()
 
-		totalCountStmt, err := db.Prepare("SELECT COUNT(*) FROM product" + conditions)
+		totalCountStmt, err := db.PrepareContext(r.Context(), "SELECT COUNT(*) FROM product"+conditions)
 		if err != nil {
-			fmt.Println("Failed to prepare count statement", err.Error())
-			http.Error(w, "Failed to prepare count statement", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "failed to prepare count statement", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 		defer totalCountStmt.Close()
 
 		var totalResult int
-		err = totalCountStmt.QueryRow(args...).Scan(&totalResult)
+		err = totalCountStmt.QueryRowContext(r.Context(), args...).Scan(&totalResult)
 		if err != nil {
-			fmt.Println("Failed to fetch total count", err.Error())
-			http.Error(w, "Failed to fetch total count", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "failed to fetch total count", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 
@@ -190,19 +222,19 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 		totalPage := (totalResult + resultPerPage - 1) / resultPerPage
 		offset := (currentPage - 1) * resultPerPage
 
-		productQueryStmt, err := db.Prepare("SELECT * FROM product" + conditions + " LIMIT ?, ?")
+		productQueryStmt, err := db.PrepareContext(r.Context(), "SELECT "+productColumns+" FROM product"+conditions+" LIMIT ?, ?")
 		if err != nil {
-			fmt.Println("Failed to prepare product query statement", err.Error())
-			http.Error(w, "Failed to prepare product query statement", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "failed to prepare product query statement", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 		defer productQueryStmt.Close()
 
 		args = append(args, offset, resultPerPage)
 
-		rows, err := productQueryStmt.Query(args...)
+		rows, err := productQueryStmt.QueryContext(r.Context(), args...)
 		if err != nil {
-			http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+			writeError(w, internalError(err))
 			return
 		}
 		defer rows.Close()
@@ -212,13 +244,20 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 			var product Product
 			err := rows.Scan(&product.ProductID, &product.ProductName, &product.ProductCategory, &product.ProductPrice, &product.ProductQuantity, &product.ProductState, &product.ProductDescription, &product.SellerID, &product.ProductImageUrl)
 			if err != nil {
-				fmt.Println("Failed to scan product data", err.Error())
-				http.Error(w, "Failed to scan product data", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "failed to scan product data", "err", err)
+				writeError(w, errInternal)
 				return
 			}
 			products = append(products, product)
 		}
 
+		err = attachProductImages(r.Context(), db, products)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+
 		// Cache the result
 		cachedResponse := CachedResponse{
 			Products:   products,
@@ -227,11 +266,11 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 
 		cacheData, err := json.Marshal(cachedResponse)
 		if err != nil {
-			log.Printf("Failed to marshal products for caching: %v\n", err)
+			slog.ErrorContext(r.Context(), "failed to marshal products for caching", "err", err)
 		} else {
 			err := rdb.Set(ctx, cacheKey, cacheData, 3*time.Minute).Err()
 			if err != nil {
-				log.Printf("Failed to set cache: %v\n", err)
+				slog.ErrorContext(r.Context(), "failed to set cache", "err", err)
 			}
 		}
 
@@ -241,18 +280,20 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 			Data:       products,
 			TotalPages: totalPage,
 		})
-		fmt.Println("data send")
+		slog.DebugContext(r.Context(), "products served from database")
 	} else if err != nil {
-		log.Printf("Failed to retrieve cache: %v\n", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		productCacheRequests.WithLabelValues("error").Inc()
+		slog.ErrorContext(r.Context(), "failed to retrieve cache", "err", err)
+		writeError(w, errInternal)
 		return
 	} else {
 		// Cache hit, use cached data
+		productCacheRequests.WithLabelValues("hit").Inc()
 		var cachedResponse CachedResponse
 		err := json.Unmarshal([]byte(cachedProducts), &cachedResponse)
 		if err != nil {
-			log.Printf("Failed to unmarshal cached products: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "failed to unmarshal cached products", "err", err)
+			writeError(w, errInternal)
 			return
 		}
 
@@ -261,32 +302,127 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 			Data:       cachedResponse.Products,
 			TotalPages: cachedResponse.TotalPages,
 		})
-		log.Printf("Send data from redis")
+		slog.DebugContext(r.Context(), "products served from cache")
 	}
 }
 
+// getProductByID serves a single active product with its images. It is not cached,
+// the listing pages are what clients poll.
+func getProductByID(w http.ResponseWriter, r *http.Request) {
+	productID, _ := pathID(r, "id")
+	if productID == 0 {
+		writeError(w, newAPIError(CodeNotFound, "Product not found"))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var product Product
+	err = db.QueryRowContext(r.Context(), "SELECT "+productColumns+" FROM product WHERE product_id = ? AND product_status = ?", productID, ProductStatusActive).
+		Scan(&product.ProductID, &product.ProductName, &product.ProductCategory, &product.ProductPrice, &product.ProductQuantity, &product.ProductState, &product.ProductDescription, &product.SellerID, &product.ProductImageUrl)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, newAPIError(CodeNotFound, "Product not found"))
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to fetch product", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	product.Images, err = fetchProductImages(r.Context(), db, productID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: product})
+}
+
+// loadImage serves an uploaded image. ?w=200 picks the smallest resized variant at
+// least that wide, falling back to the full size image when none is large enough.
 func loadImage(w http.ResponseWriter, r *http.Request) {
-	filename := filepath.Base(r.URL.Path)
-	fmt.Println(filename)
-	file, err := os.Open(filepath.Join("uploads", filename))
+	filename := blobKeyFromURL(r.URL.Path)
+	if blobPrivate(filename) && !verifyImageURL(filename, r.URL.Query()) {
+		writeError(w, newAPIError(CodeForbidden, "Invalid or expired image URL"))
+		return
+	}
+	if width, err := strconv.Atoi(r.URL.Query().Get("w")); err == nil && width > 0 {
+		filename = selectImageVariant(r.Context(), filename, width)
+	}
+	file, err := blobStore.Get(r.Context(), filename)
 	if err != nil {
-		log.Printf("Error opening image file: %v\n", err)
-		http.Error(w, "Image not found", http.StatusNotFound)
+		slog.ErrorContext(r.Context(), "error opening image file", "err", err)
+		if err == errBlobNotFound || err == errBlobKey {
+			writeError(w, newAPIError(CodeNotFound, "Image not found"))
+			return
+		}
+		writeError(w, errInternal)
 		return
 	}
 	defer file.Close()
 
-	// Get file extension
-	ext := filepath.Ext(filename)
+	info := file.Info()
+	setImageCacheHeaders(w, r, filename, info)
 
-	// Set content type based on file extension
-	contentType := "image/" + ext[1:] // Remove the dot from the extension
+	// ServeContent sniffs the first bytes when no Content-Type is set
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	// Set the content type header
-	w.Header().Set("Content-Type", contentType)
+	// ServeContent answers If-None-Match, If-Modified-Since and Range requests
+	http.ServeContent(w, r, filename, info.ModTime, file)
+}
 
-	// Serve the file
-	http.ServeContent(w, r, filename, time.Now(), file)
+// contentAddressedName matches uploads named after the sha256 of the processed bytes
+// stored for them, including the resized variants, see processUpload. Such a name
+// always refers to the same bytes, a pipeline change stores under new names.
+var contentAddressedName = regexp.MustCompile(`^([0-9a-f]{64}(?:_w[0-9]+)?)\.[a-z0-9]+$`)
+
+// setImageCacheHeaders lets clients keep content addressed images forever and use
+// the hash in the name as a strong ETag. Files uploaded before names were hashes
+// can still be replaced in place, they get a weak validator and a short lifetime.
+// Private images are never kept in shared caches and not beyond their URL's expiry.
+func setImageCacheHeaders(w http.ResponseWriter, r *http.Request, filename string, info BlobInfo) {
+	m := contentAddressedName.FindStringSubmatch(path.Base(filename))
+	if m != nil {
+		w.Header().Set("ETag", `"`+m[1]+`"`)
+	} else {
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.ModTime.Unix(), info.Size))
+	}
+
+	switch {
+	case blobPrivate(filename):
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", max(0, expires-time.Now().Unix())))
+	case m != nil:
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+}
+
+func selectImageVariant(ctx context.Context, filename string, width int) string {
+	for _, variantWidth := range imageVariantWidths {
+		if variantWidth < width {
+			continue
+		}
+		variant := variantName(filename, variantWidth)
+		if _, err := blobStore.Stat(ctx, variant); err == nil {
+			return variant
+		}
+	}
+	return filename
 }
 
 func loadImage2(w http.ResponseWriter, r *http.Request) {
@@ -295,7 +431,7 @@ func loadImage2(w http.ResponseWriter, r *http.Request) {
 	// Assuming imagePath contains the path to your image file
 	imageFile, err := os.Open(imagePath)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Image not found: %s", err.Error()), http.StatusNotFound)
+		writeError(w, newAPIError(CodeNotFound, "Image not found"))
 		return
 	}
 	defer imageFile.Close()
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetImageCacheHeaders(t *testing.T) {
+	hash := strings.Repeat("3a", 32)
+	info := BlobInfo{Size: 1234, ModTime: time.Unix(1700000000, 0)}
+	expires := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		filename     string
+		query        string
+		etag         string
+		cacheControl string
+	}{
+		{hash + ".jpg", "", `"` + hash + `"`, "public, max-age=31536000, immutable"},
+		{hash + "_w400.jpg", "", `"` + hash + `_w400"`, "public, max-age=31536000, immutable"},
+		{"photo.jpg", "", `W/"6553f100-4d2"`, "public, max-age=3600"},
+		{hash + "-copy.jpg", "", `W/"6553f100-4d2"`, "public, max-age=3600"},
+		{"private/" + hash + ".jpg", "?expires=" + strconv.FormatInt(expires, 10), `"` + hash + `"`, "private, max-age="},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		setImageCacheHeaders(w, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil), tt.filename, info)
+		if got := w.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("%s: ETag %s, want %s", tt.filename, got, tt.etag)
+		}
+		if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, tt.cacheControl) {
+			t.Errorf("%s: Cache-Control %q, want %q", tt.filename, got, tt.cacheControl)
+		}
+	}
+}
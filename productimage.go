@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxProductImages = 6
+
+type ProductImage struct {
+	ID    int    `json:"product_image_id"`
+	URL   string `json:"product_image_url"`
+	Order int    `json:"product_image_order"`
+}
+
+type ProductImageRequest struct {
+	ProductID int   `json:"product_id"`
+	ImageID   int   `json:"product_image_id,omitempty"`
+	ImageIDs  []int `json:"product_image_ids,omitempty"`
+}
+
+var errUploadMissing = newAPIError(CodeBadRequest, "Error retrieving the image file")
+
+var errUploadTooMany = newAPIError(CodeBadRequest, fmt.Sprintf("A product can have at most %d images", maxProductImages))
+
+// checkUploads checks the type and dimensions of every file before anything is
+// stored, so one bad file rejects the whole request. The pixels are only decoded
+// by stageUploads.
+func checkUploads(files []*multipart.FileHeader) error {
+	if len(files) == 0 {
+		return errUploadMissing
+	}
+	if len(files) > maxProductImages {
+		return errUploadTooMany
+	}
+
+	for _, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		_, _, err = readUpload(file, header)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageUploads decodes, resizes and stages one file at a time, so a request never
+// holds more than one decoded image. A file that only fails to decode here discards
+// what was staged before it.
+func stageUploads(ctx context.Context, files []*multipart.FileHeader) ([]*stagedUpload, error) {
+	staged := make([]*stagedUpload, 0, len(files))
+	for _, header := range files {
+		s, err := stageFile(ctx, header)
+		if err != nil {
+			discardUploads(ctx, staged)
+			return nil, err
+		}
+		staged = append(staged, s)
+	}
+	return staged, nil
+}
+
+func stageFile(ctx context.Context, header *multipart.FileHeader) (*stagedUpload, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	upload, err := validateUpload(file, header)
+	if err != nil {
+		return nil, err
+	}
+	return stageUpload(ctx, upload, BlobPublic)
+}
+
+func promoteUploads(ctx context.Context, staged []*stagedUpload) error {
+	for _, s := range staged {
+		if err := s.promote(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func discardUploads(ctx context.Context, staged []*stagedUpload) {
+	for _, s := range staged {
+		s.discard(ctx)
+	}
+}
+
+func stagedURLs(staged []*stagedUpload) []string {
+	urls := make([]string, len(staged))
+	for i, s := range staged {
+		urls[i] = s.URL
+	}
+	return urls
+}
+
+func insertProductImages(ctx context.Context, tx *sql.Tx, productID int64, urls []string, firstOrder int) error {
+	for i, url := range urls {
+		_, err := tx.ExecContext(ctx, "INSERT INTO product_image (product_id, product_image_url, product_image_order) VALUES (?, ?, ?)", productID, url, firstOrder+i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertWithUploads runs insert in a transaction and makes the staged uploads
+// visible only when it succeeded. They are promoted right before the commit, so a
+// committed row never points at a missing blob. If the commit itself fails the
+// promoted blobs are unreferenced and left to the upload GC.
+func insertWithUploads(ctx context.Context, db *sql.DB, staged []*stagedUpload, insert func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		discardUploads(ctx, staged)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insert(tx)
+	if err == nil {
+		err = promoteUploads(ctx, staged)
+	}
+	if err != nil {
+		discardUploads(ctx, staged)
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncPrimaryImage copies the first image into product.product_image_url for clients
+// that only know about a single image.
+func syncPrimaryImage(ctx context.Context, tx *sql.Tx, productID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE product SET product_image_url = COALESCE((SELECT product_image_url FROM product_image WHERE product_id = ? ORDER BY product_image_order, product_image_id LIMIT 1), '') WHERE product_id = ?", productID, productID)
+	return err
+}
+
+// attachProductImages fills Images of every product with a single query.
+func attachProductImages(ctx context.Context, db *sql.DB, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	index := make(map[int]int, len(products))
+	for i, product := range products {
+		placeholders[i] = "?"
+		args[i] = product.ProductID
+		index[product.ProductID] = i
+		products[i].Images = []ProductImage{}
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT product_image_id, product_id, product_image_url, product_image_order FROM product_image WHERE product_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY product_id, product_image_order, product_image_id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var image ProductImage
+		var productID int
+		if err := rows.Scan(&image.ID, &productID, &image.URL, &image.Order); err != nil {
+			return err
+		}
+		if i, ok := index[productID]; ok {
+			products[i].Images = append(products[i].Images, image)
+		}
+	}
+	return rows.Err()
+}
+
+// canEditProduct reports whether the authenticated user may change productID:
+// the seller who listed it, or an admin.
+func canEditProduct(ctx context.Context, db *sql.DB, productID int, claims *Claims) (bool, error) {
+	var sellerID string
+	err := db.QueryRowContext(ctx, "SELECT seller_id FROM product WHERE product_id = ? AND product_status <> ?", productID, ProductStatusDeleted).Scan(&sellerID)
+	if err != nil {
+		return false, err
+	}
+	return claims.Role == RoleAdmin || sellerID == claims.UserID, nil
+}
+
+// checkProductAccess answers the request itself and returns false when the product
+// does not exist or belongs to someone else.
+func checkProductAccess(w http.ResponseWriter, r *http.Request, db *sql.DB, productID int) bool {
+	claims, _ := claimsFromContext(r.Context())
+	allowed, err := canEditProduct(r.Context(), db, productID, claims)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, newAPIError(CodeNotFound, "Product not found"))
+			return false
+		}
+		slog.ErrorContext(r.Context(), "failed to fetch product", "err", err)
+		writeError(w, errInternal)
+		return false
+	}
+	if !allowed {
+		writeError(w, newAPIError(CodeForbidden, "Not your product"))
+		return false
+	}
+	return true
+}
+
+func fetchProductImages(ctx context.Context, db *sql.DB, productID int) ([]ProductImage, error) {
+	products := []Product{{ProductID: productID}}
+	err := attachProductImages(ctx, db, products)
+	return products[0].Images, err
+}
+
+// addProductImages appends images to an existing product, multipart with one or more
+// product_image files. The legacy path takes product_id as a form field.
+func addProductImages(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error parsing multipart form", "err", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, errUploadTooLarge)
+			return
+		}
+		writeError(w, newAPIError(CodeBadRequest, "Invalid multipart form"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	productID, ok := pathID(r, "id")
+	if !ok {
+		productID, _ = strconv.Atoi(r.FormValue("product_id"))
+	}
+	if productID <= 0 {
+		writeError(w, newAPIError(CodeBadRequest, "Invalid product_id"))
+		return
+	}
+
+	uploads := r.MultipartForm.File["product_image"]
+	if err := checkUploads(uploads); err != nil {
+		slog.ErrorContext(r.Context(), "image validation error", "err", err)
+		writeError(w, err)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	if !checkProductAccess(w, r, db, productID) {
+		return
+	}
+
+	existing, err := fetchProductImages(r.Context(), db, productID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if len(existing)+len(uploads) > maxProductImages {
+		writeError(w, errUploadTooMany)
+		return
+	}
+
+	staged, err := stageUploads(r.Context(), uploads)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	nextOrder := 0
+	if len(existing) > 0 {
+		nextOrder = existing[len(existing)-1].Order + 1
+	}
+
+	err = insertWithUploads(r.Context(), db, staged, func(tx *sql.Tx) error {
+		err := insertProductImages(r.Context(), tx, int64(productID), stagedURLs(staged), nextOrder)
+		if err != nil {
+			return err
+		}
+		return syncPrimaryImage(r.Context(), tx, productID)
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to add product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	respondProductImages(w, r, db, productID)
+}
+
+// reorderProductImages takes the complete list of image ids in their new order, a PUT
+// of the image collection on the v1 path.
+func reorderProductImages(w http.ResponseWriter, r *http.Request) {
+	var req ProductImageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if productID, ok := pathID(r, "id"); ok {
+		req.ProductID = productID
+	}
+	if err != nil || req.ProductID == 0 || len(req.ImageIDs) == 0 {
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	if !checkProductAccess(w, r, db, req.ProductID) {
+		return
+	}
+
+	existing, err := fetchProductImages(r.Context(), db, req.ProductID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// The new order has to name every image of the product exactly once
+	remaining := make(map[int]bool, len(existing))
+	for _, image := range existing {
+		remaining[image.ID] = true
+	}
+	for _, id := range req.ImageIDs {
+		if !remaining[id] {
+			writeError(w, newAPIError(CodeBadRequest, "product_image_ids must list every image of the product once"))
+			return
+		}
+		delete(remaining, id)
+	}
+	if len(remaining) > 0 {
+		writeError(w, newAPIError(CodeBadRequest, "product_image_ids must list every image of the product once"))
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to begin transaction", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	for order, id := range req.ImageIDs {
+		_, err = tx.ExecContext(r.Context(), "UPDATE product_image SET product_image_order = ? WHERE product_image_id = ? AND product_id = ?", order, id, req.ProductID)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = syncPrimaryImage(r.Context(), tx, req.ProductID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to reorder product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	respondProductImages(w, r, db, req.ProductID)
+}
+
+// deleteProductImage removes one image from a product. The blob itself is left to
+// the upload garbage collector since identical uploads share blobs.
+func deleteProductImage(w http.ResponseWriter, r *http.Request) {
+	var req ProductImageRequest
+	if productID, ok := pathID(r, "id"); ok {
+		req.ProductID = productID
+		req.ImageID, _ = pathID(r, "imageID")
+		if req.ProductID == 0 || req.ImageID == 0 {
+			writeError(w, newAPIError(CodeNotFound, "Image not found"))
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ProductID == 0 || req.ImageID == 0 {
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	if !checkProductAccess(w, r, db, req.ProductID) {
+		return
+	}
+
+	existing, err := fetchProductImages(r.Context(), db, req.ProductID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	found := false
+	for _, image := range existing {
+		found = found || image.ID == req.ImageID
+	}
+	if !found {
+		writeError(w, newAPIError(CodeNotFound, "Image not found"))
+		return
+	}
+	if len(existing) == 1 {
+		writeError(w, newAPIError(CodeBadRequest, "A product needs at least one image"))
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to begin transaction", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(r.Context(), "DELETE FROM product_image WHERE product_image_id = ? AND product_id = ?", req.ImageID, req.ProductID)
+	if err == nil {
+		err = syncPrimaryImage(r.Context(), tx, req.ProductID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete product image", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	respondProductImages(w, r, db, req.ProductID)
+}
+
+func respondProductImages(w http.ResponseWriter, r *http.Request, db *sql.DB, productID int) {
+	invalidateProductCache(r.Context())
+
+	images, err := fetchProductImages(r.Context(), db, productID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product images", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: images})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+type ProfileUpdate struct {
+	Name    *string `json:"user_name"`
+	Gender  *string `json:"User_gender"`
+	Phone   *string `json:"user_phone"`
+	Address *string `json:"user_address"`
+}
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+func validPhone(phone string) bool {
+	return e164Pattern.MatchString(phone)
+}
+
+func fetchUser(ctx context.Context, db *sql.DB, userID string) (User, error) {
+	var user User
+	var gender, phone, address, photo sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT user_id, user_name, user_email, user_gender, user_phone, user_address, user_photo, user_role FROM user WHERE user_id = ?", userID).
+		Scan(&user.ID, &user.Name, &user.Email, &gender, &phone, &address, &photo, &user.Role)
+	if err != nil {
+		return User{}, err
+	}
+	user.Gender = gender.String
+	user.Phone = phone.String
+	user.Address = address.String
+	user.Photo = photo.String
+	return user, nil
+}
+
+// getProfile serves the authenticated user's own profile, updateProfile changes it.
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	user, err := fetchUser(r.Context(), db, claims.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, newAPIError(CodeNotFound, "User not found"))
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	user.Photo = presentImageURL(user.Photo)
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: user})
+}
+
+func updateProfile(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	var req ProfileUpdate
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+
+	// Only the fields present in the body are changed, an empty string clears an optional field
+	var sets []string
+	var args []interface{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > 100 {
+			writeError(w, newAPIError(CodeBadRequest, "Invalid user_name"))
+			return
+		}
+		sets = append(sets, "user_name = ?")
+		args = append(args, name)
+	}
+	if req.Gender != nil {
+		if utf8.RuneCountInString(*req.Gender) > 20 {
+			writeError(w, newAPIError(CodeBadRequest, "Invalid user_gender"))
+			return
+		}
+		sets = append(sets, "user_gender = ?")
+		args = append(args, nullIfEmpty(*req.Gender))
+	}
+	if req.Phone != nil {
+		phone := strings.NewReplacer(" ", "", "-", "").Replace(*req.Phone)
+		if phone != "" && !validPhone(phone) {
+			writeError(w, newAPIError(CodeBadRequest, "user_phone must be in E.164 format, e.g. +6281234567890"))
+			return
+		}
+		sets = append(sets, "user_phone = ?")
+		args = append(args, nullIfEmpty(phone))
+	}
+	if req.Address != nil {
+		if utf8.RuneCountInString(*req.Address) > 255 {
+			writeError(w, newAPIError(CodeBadRequest, "Invalid user_address"))
+			return
+		}
+		sets = append(sets, "user_address = ?")
+		args = append(args, nullIfEmpty(*req.Address))
+	}
+	if len(sets) == 0 {
+		writeError(w, newAPIError(CodeBadRequest, "Nothing to update"))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	args = append(args, claims.UserID)
+	_, err = db.ExecContext(r.Context(), "UPDATE user SET "+strings.Join(sets, ", ")+" WHERE user_id = ?", args...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update profile", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	user, err := fetchUser(r.Context(), db, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	user.Photo = presentImageURL(user.Photo)
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: user})
+}
+
+func uploadProfilePhoto(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	err := r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error parsing multipart form", "err", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, errUploadTooLarge)
+			return
+		}
+		writeError(w, newAPIError(CodeBadRequest, "Invalid multipart form"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	photo, handler, err := r.FormFile("user_photo")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving the image file", "err", err)
+		writeError(w, newAPIError(CodeBadRequest, "Error retrieving the image file"))
+		return
+	}
+	defer photo.Close()
+
+	// Profile photos are only visible through signed URLs
+	url, err := saveUpload(r.Context(), photo, handler, BlobPrivate)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE user SET user_photo = ? WHERE user_id = ?", url, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update profile photo", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: map[string]string{"user_photo": presentImageURL(url)}})
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
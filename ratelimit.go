@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit describes a token bucket: Burst tokens at most, refilled at Rate tokens per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func PerMinute(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 60, Burst: n}
+}
+
+func PerHour(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 3600, Burst: n}
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, only set when not allowed
+}
+
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type RateLimitKeyFunc func(r *http.Request) string
+
+// rateLimiter is shared by every rate limited route. Set TANAM_RATE_LIMIT_STORE=memory
+// to keep buckets in process when running a single instance without redis.
+var rateLimiter = newRateLimiter(config.RateLimitStore)
+
+func newRateLimiter(store string) RateLimiter {
+	if store == "memory" {
+		return newMemoryRateLimiter()
+	}
+	return newRedisRateLimiter(rdb)
+}
+
+func bucketResult(tokens float64, allowed bool, limit RateLimit) RateLimitResult {
+	res := RateLimitResult{
+		Allowed:    allowed,
+		Limit:      limit.Burst,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (l *memoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return bucketResult(b.tokens, allowed, limit), nil
+}
+
+// sweep forgets buckets that have been idle long enough to be full again anyway.
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// The whole refill-and-take runs inside redis so concurrent instances never race on a bucket.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+func newRedisRateLimiter(client *redis.Client) *redisRateLimiter {
+	return &redisRateLimiter{client: client}
+}
+
+func (l *redisRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now().UnixMilli()
+	res, err := tokenBucketScript.Run(ctx, l.client, []string{"rate_limit:" + key}, limit.Rate, limit.Burst, now).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	allowed, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return bucketResult(tokens, allowed == 1, limit), nil
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, res RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.ResetAfter.Seconds()))))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func RateLimitByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// RateLimitByAPIKey needs APIKeyMiddleware to have run, otherwise it falls back to the client IP.
+func RateLimitByAPIKey(r *http.Request) string {
+	if key, ok := apiKeyFromContext(r.Context()); ok {
+		return "api_key:" + strconv.Itoa(key.ID)
+	}
+	return RateLimitByIP(r)
+}
+
+// RateLimitByUser needs JWTMiddleware to have run, otherwise it falls back to the client IP.
+func RateLimitByUser(r *http.Request) string {
+	if claims, ok := claimsFromContext(r.Context()); ok && claims.UserID != "" {
+		return "user:" + claims.UserID
+	}
+	return RateLimitByIP(r)
+}
+
+// RateLimitMiddleware throttles requests per key with a token bucket. name separates
+// the buckets of different routes, so the same client can have a budget per route.
+// When the limiter itself fails the request is let through rather than taking the API down.
+func RateLimitMiddleware(name string, limit RateLimit, keyFunc RateLimitKeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := rateLimiter.Allow(r.Context(), name+":"+keyFunc(r), limit)
+			if err != nil {
+				slog.Error("rate limiter error", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			writeRateLimitHeaders(w, res)
+			if !res.Allowed {
+				writeError(w, errRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
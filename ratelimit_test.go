@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiterBurst(t *testing.T) {
+	l := newMemoryRateLimiter()
+	ctx := context.Background()
+	limit := PerMinute(3)
+
+	for i := 0; i < 3; i++ {
+		res, err := l.Allow(ctx, "a", limit)
+		if err != nil || !res.Allowed {
+			t.Fatalf("request %d: %+v, %v", i+1, res, err)
+		}
+		if res.Limit != 3 || res.Remaining != 2-i {
+			t.Errorf("request %d: limit %d remaining %d", i+1, res.Limit, res.Remaining)
+		}
+	}
+
+	res, _ := l.Allow(ctx, "a", limit)
+	if res.Allowed {
+		t.Fatal("request over the burst allowed")
+	}
+	// One token every 20s at 3 per minute
+	if res.RetryAfter <= 19*time.Second || res.RetryAfter > 20*time.Second {
+		t.Errorf("RetryAfter = %v, want about 20s", res.RetryAfter)
+	}
+
+	if res, _ := l.Allow(ctx, "b", limit); !res.Allowed {
+		t.Error("other key shares the bucket")
+	}
+}
+
+func TestMemoryRateLimiterRefill(t *testing.T) {
+	l := newMemoryRateLimiter()
+	ctx := context.Background()
+	limit := PerMinute(6)
+
+	for i := 0; i < 6; i++ {
+		l.Allow(ctx, "a", limit)
+	}
+	// Pretend 30s went by, which refills half of the bucket
+	l.buckets["a"].last = l.buckets["a"].last.Add(-30 * time.Second)
+	for i := 0; i < 3; i++ {
+		if res, _ := l.Allow(ctx, "a", limit); !res.Allowed {
+			t.Fatalf("request %d after refill denied", i+1)
+		}
+	}
+	if res, _ := l.Allow(ctx, "a", limit); res.Allowed {
+		t.Error("refilled more than elapsed time allows")
+	}
+
+	// A long idle bucket is full, never more than the burst
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	res, _ := l.Allow(ctx, "a", limit)
+	if res.Remaining != 5 {
+		t.Errorf("Remaining after idle = %d, want 5", res.Remaining)
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	l := newMemoryRateLimiter()
+	ctx := context.Background()
+	l.Allow(ctx, "idle", PerMinute(1))
+	l.buckets["idle"].last = time.Now().Add(-2 * time.Hour)
+	l.lastSweep = time.Now().Add(-2 * time.Minute)
+
+	l.Allow(ctx, "busy", PerMinute(1))
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket not swept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("active bucket swept")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	saved := rateLimiter
+	rateLimiter = newMemoryRateLimiter()
+	defer func() { rateLimiter = saved }()
+
+	handler := RateLimitMiddleware("test", PerMinute(2), RateLimitByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("192.0.2.1:1234"); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	w := request("192.0.2.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("headers = %v", w.Header())
+	}
+	if w := request("192.0.2.2:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("other client: status %d", w.Code)
+	}
+}
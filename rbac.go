@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	RoleBuyer  = "buyer"
+	RoleSeller = "seller"
+	RoleAdmin  = "admin"
+)
+
+const (
+	UserStatusActive = "active"
+	UserStatusBanned = "banned"
+	// UserStatusDeleted marks an anonymized account, see deleteAccount
+	UserStatusDeleted = "deleted"
+)
+
+const (
+	ProductStatusActive  = "active"
+	ProductStatusHidden  = "hidden"
+	ProductStatusRemoved = "removed"
+	ProductStatusDeleted = "deleted"
+)
+
+const claimsContextKey contextKey = "claims"
+
+type ModerationRequest struct {
+	ProductID int    `json:"product_id,omitempty"`
+	UserID    int    `json:"user_id,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Role      string `json:"user_role,omitempty"`
+}
+
+func claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// RequireRole only lets through users whose access token carries one of the given roles.
+// It must run after JWTMiddleware, so list it before JWTMiddleware in ChainMiddleware:
+//
+//	ChainMiddleware(h, LoggingMiddleware, APIKeyMiddleware, RequireRole(RoleSeller), JWTMiddleware)
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := claimsFromContext(r.Context())
+			if !ok {
+				writeError(w, errUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if claims.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			slog.WarnContext(r.Context(), "role not allowed", "role", claims.Role, "path", r.URL.Path)
+			writeError(w, errForbidden)
+		})
+	}
+}
+
+// invalidateProductCache drops every cached getProduct page so moderation is visible immediately.
+func invalidateProductCache(ctx context.Context) {
+	iter := rdb.Scan(ctx, 0, "products:*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := rdb.Del(ctx, iter.Val()).Err(); err != nil {
+			slog.ErrorContext(ctx, "failed to delete product cache", "key", iter.Val(), "err", err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.ErrorContext(ctx, "failed to scan product cache", "err", err)
+	}
+}
+
+func moderateProduct(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+	if id, ok := pathID(r, "id"); ok {
+		req.ProductID = id
+	}
+
+	var status string
+	switch req.Action {
+	case "hide":
+		status = ProductStatusHidden
+	case "unhide":
+		status = ProductStatusActive
+	case "remove":
+		status = ProductStatusRemoved
+	}
+	if req.ProductID == 0 || status == "" {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var exists int
+	err = db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM product WHERE product_id = ?", req.ProductID).Scan(&exists)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch product", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if exists == 0 {
+		writeError(w, newAPIError(CodeNotFound, "Product not found"))
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE product SET product_status = ? WHERE product_id = ?", status, req.ProductID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to moderate product", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	invalidateProductCache(r.Context())
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Product " + status})
+}
+
+func moderateUser(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+	if id, ok := pathID(r, "id"); ok {
+		req.UserID = id
+	}
+
+	var status string
+	switch req.Action {
+	case "ban":
+		status = UserStatusBanned
+	case "unban":
+		status = UserStatusActive
+	}
+	if req.UserID == 0 || status == "" {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	updateUserColumn(w, r, "user_status", status, req.UserID)
+}
+
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+	if id, ok := pathID(r, "id"); ok {
+		req.UserID = id
+	}
+
+	if req.UserID == 0 || (req.Role != RoleBuyer && req.Role != RoleSeller && req.Role != RoleAdmin) {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	updateUserColumn(w, r, "user_role", req.Role, req.UserID)
+}
+
+// updateUserColumn backs the admin user endpoints. column is never user input.
+func updateUserColumn(w http.ResponseWriter, r *http.Request, column string, value string, userID int) {
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var exists int
+	err = db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM user WHERE user_id = ?", userID).Scan(&exists)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if exists == 0 {
+		writeError(w, newAPIError(CodeNotFound, "User not found"))
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE user SET "+column+" = ? WHERE user_id = ?", value, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update", "column", column, "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "User updated"})
+}
@@ -4,81 +4,96 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
 
 	_ "github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
+
+	"tanamdev/validation"
 )
 
 func createUser(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("JSON decoding error: %v\n", err)
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: err.Error()})
+		slog.WarnContext(r.Context(), "JSON decoding error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
 		return
 	}
 
 	name := r.FormValue("user_name")
 	email := r.FormValue("user_email")
 	password := r.FormValue("user_password")
-	if name == "" || email == "" || password == "" {
-		fmt.Println("Form empty error")
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: nil})
+	role := r.FormValue("user_role")
+	if role == "" {
+		role = RoleBuyer
+	}
+
+	v := validation.New()
+	if v.Required("user_name", name) {
+		v.Length("user_name", name, 1, maxNameLength)
+	}
+	if v.Required("user_email", email) {
+		v.Length("user_email", email, 3, maxEmailLength)
+		v.Email("user_email", email)
+	}
+	if v.Required("user_password", password) {
+		v.Length("user_password", password, minPasswordLength, 0)
+		v.Check(len(password) <= maxPasswordLength, "user_password", fmt.Sprintf("must be at most %d bytes", maxPasswordLength))
+	}
+	v.OneOf("user_role", role, RoleBuyer, RoleSeller)
+	if !v.Valid() {
+		slog.InfoContext(r.Context(), "form validation failed", "errors", v.Errors())
+		writeError(w, v.Errors())
 		return
 	}
 	// Encrypt the password with bcrypt
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		fmt.Println("Password hashing error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		slog.ErrorContext(r.Context(), "password hashing error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
-	fmt.Println(name)
-	fmt.Println(email)
-	fmt.Println(password)
-	fmt.Println(hashedPassword)
-
-	db, err := dbConnect(w)
+	db, err := dbConnect(r.Context(), w)
 	if err != nil {
-		fmt.Println("dbconnect error:", err.Error())
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
 		return
 	}
 
-	stmtCount, err := db.Prepare("SELECT COUNT(*) FROM user WHERE user_email = ?")
+	stmtCount, err := db.PrepareContext(r.Context(), "SELECT COUNT(*) FROM user WHERE user_email = ?")
 	if err != nil {
-		fmt.Println("SQL Prepare error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: err})
+		slog.ErrorContext(r.Context(), "SQL Prepare error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer stmtCount.Close()
 
 	var count int
-	err = stmtCount.QueryRow(email).Scan(&count)
+	err = stmtCount.QueryRowContext(r.Context(), email).Scan(&count)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "failed", Data: nil})
+		writeError(w, internalError(err))
 		return
 	}
 	if count > 0 { // Email already exists, handle the error
-		sendJSONResponse(w, http.StatusBadRequest, Response{Status: "failed", Data: "Email already exist"})
+		writeError(w, newAPIError(CodeConflict, "Email already exists"))
 		return
 	}
 
 	otp := generateOTP()
 
-	stmt, err := db.Prepare("INSERT INTO user (user_name, user_email, user_password) VALUES (?, ?, ?)")
+	stmt, err := db.PrepareContext(r.Context(), "INSERT INTO user (user_name, user_email, user_password, user_role) VALUES (?, ?, ?, ?)")
 	if err != nil {
-		fmt.Println("SQL Prepare error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "prepare failed", Data: nil})
+		slog.ErrorContext(r.Context(), "SQL Prepare error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(name, email, hashedPassword)
+	_, err = stmt.ExecContext(r.Context(), name, email, hashedPassword, role)
 	if err != nil {
-		fmt.Println("Execute error:", err.Error())
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "Execute failed", Data: nil})
+		slog.ErrorContext(r.Context(), "execute error", "err", err)
+		writeError(w, errInternal)
 		return
 	}
 	sendMail(w, otp, email)
@@ -99,22 +114,43 @@ func sendMail(w http.ResponseWriter, otp int, to string) {
 
 	jsonPayload, err := json.Marshal(payload) //same like stringify
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("failed to encode mail payload", "err", err)
 		return
 	}
-	log.Println("Payload to be sent:", string(jsonPayload))
 	resp, err := http.Post("https://script.google.com/macros/s/AKfycbzBp3LargzIzRtS8yie8tXSDdE9NtZEcjEwfT60gjilLY6nBAti89fXRLAgeoOnUo4acg/exec", "application/json", bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		fmt.Println("Error:", err)
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "error", Data: err.Error()})
+		slog.Error("failed to send mail", "err", err)
+		countEmail("otp", err)
+		writeError(w, errMailFailed)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Error: Failed to send data to the API")
-		sendJSONResponse(w, http.StatusInternalServerError, Response{Status: "error", Data: resp.StatusCode})
+		slog.Error("mail api failed", "status", resp.StatusCode)
+		countEmail("otp", errMailFailed)
+		writeError(w, errMailFailed)
 		return
 	}
-	fmt.Println("Email sent successfully")
+	countEmail("otp", nil)
+	slog.Info("email sent")
+}
+
+// postMail sends a payload to one of the mail scripts, the script decides the template.
+func postMail(scriptURL string, payload map[string]interface{}) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(scriptURL, "application/json", bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mail script returned status %d", resp.StatusCode)
+	}
+	return nil
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeLimit is the rate limit of a single route, see RateLimitMiddleware.
+type routeLimit struct {
+	name  string
+	limit RateLimit
+	key   RateLimitKeyFunc
+}
+
+// route is one endpoint of the API. Its middleware is derived from the fields, so
+// every route gets the same stack in the same order and a new endpoint cannot
+// forget the API key or the timeout.
+type route struct {
+	method  string
+	path    string   // may hold {wildcards}
+	aliases []string // older patterns of the same endpoint that clients still call
+	handler http.HandlerFunc
+
+	public bool     // served without an API key, e.g. images loaded by <img> tags
+	scope  string   // API key scope the route requires
+	user   bool     // requires a session token
+	roles  []string // roles allowed, only with user
+
+	rateLimit *routeLimit
+	maxBody   int64         // request body limit, maxRequestBodySize when 0
+	timeout   time.Duration // deadline, config.RequestTimeout when 0
+	streaming bool          // the response is streamed and must not be buffered by TimeoutMiddleware
+}
+
+// apiPrefix is the version every current path lives under. Breaking changes get a
+// new prefix while the old one keeps being served.
+const apiPrefix = "/api/tanam/v1"
+
+var sellerRoles = []string{RoleSeller, RoleAdmin}
+
+// apiRoutes lists every endpoint. Aliases without a method are the paths from
+// before routes had methods and keep accepting any method, as they always did.
+func apiRoutes() []route {
+	loginLimit := &routeLimit{"login", PerMinute(20), RateLimitByIP}
+	// Per client IP, every install of the app sends the same API key
+	productLimit := &routeLimit{"getproduct", PerMinute(120), RateLimitByIP}
+
+	return []route{
+		{method: http.MethodPost, path: apiPrefix + "/users", aliases: []string{"/api/tanam/register", "/register"}, handler: createUser, rateLimit: &routeLimit{"register", PerMinute(10), RateLimitByIP}},
+		{method: http.MethodPost, path: apiPrefix + "/login", aliases: []string{"/api/tanam/login", "/api/tanam/login2", "/login"}, handler: loginHandler, rateLimit: loginLimit},
+		{method: http.MethodPost, path: apiPrefix + "/login/2fa", aliases: []string{"/api/tanam/login/2fa"}, handler: loginTOTPHandler, rateLimit: loginLimit},
+		{method: http.MethodPost, path: apiPrefix + "/refresh", aliases: []string{"/api/tanam/refresh", "/refresh"}, handler: refreshHandler},
+		{method: http.MethodPost, path: apiPrefix + "/password/forgot", aliases: []string{"/api/tanam/forgotpassword"}, handler: forgotPassword, rateLimit: &routeLimit{"forgotpassword", PerMinute(5), RateLimitByIP}},
+
+		{method: http.MethodGet, path: apiPrefix + "/products", aliases: []string{"/api/tanam/getproduct", "/getProduct"}, handler: getProduct, rateLimit: productLimit},
+		{method: http.MethodPost, path: apiPrefix + "/products", aliases: []string{"/api/tanam/insertproduct"}, handler: insertProduct, user: true, roles: sellerRoles, maxBody: maxProductUploadBody, timeout: config.UploadTimeout},
+		{method: http.MethodGet, path: apiPrefix + "/products/{id}", handler: getProductByID, rateLimit: productLimit},
+		{method: http.MethodPost, path: apiPrefix + "/products/{id}/images", aliases: []string{"/api/tanam/product/images"}, handler: addProductImages, user: true, roles: sellerRoles, maxBody: maxProductUploadBody, timeout: config.UploadTimeout},
+		{method: http.MethodPut, path: apiPrefix + "/products/{id}/images", aliases: []string{"/api/tanam/product/images/reorder"}, handler: reorderProductImages, user: true, roles: sellerRoles},
+		{method: http.MethodDelete, path: apiPrefix + "/products/{id}/images/{imageID}", aliases: []string{"/api/tanam/product/images/delete"}, handler: deleteProductImage, user: true, roles: sellerRoles},
+		// Outside apiPrefix, image URLs are stored in the database and handed out signed
+		{method: http.MethodGet, path: "/api/tanam/loadimage/", handler: loadImage, public: true, streaming: true},
+
+		{method: http.MethodGet, path: apiPrefix + "/profile", aliases: []string{"GET /api/tanam/profile"}, handler: getProfile, user: true},
+		{method: http.MethodPatch, path: apiPrefix + "/profile", aliases: []string{"PATCH /api/tanam/profile"}, handler: updateProfile, user: true},
+		{method: http.MethodPut, path: apiPrefix + "/profile/photo", aliases: []string{"/api/tanam/profile/photo"}, handler: uploadProfilePhoto, user: true, maxBody: maxPhotoUploadBody, timeout: config.UploadTimeout},
+		{method: http.MethodPut, path: apiPrefix + "/account/password", aliases: []string{"/api/tanam/account/password"}, handler: changePassword, user: true, rateLimit: &routeLimit{"changepassword", PerMinute(5), RateLimitByUser}},
+		// POST rather than DELETE, the password confirming it is sent as a form and Go only parses form bodies of POST, PUT and PATCH
+		{method: http.MethodPost, path: apiPrefix + "/account/delete", aliases: []string{"/api/tanam/account/delete"}, handler: deleteAccount, user: true, rateLimit: &routeLimit{"deleteaccount", PerMinute(5), RateLimitByUser}},
+		{method: http.MethodPost, path: apiPrefix + "/2fa/enroll", aliases: []string{"/api/tanam/2fa/enroll"}, handler: enrollTOTP, user: true, roles: sellerRoles},
+		{method: http.MethodPost, path: apiPrefix + "/2fa/confirm", aliases: []string{"/api/tanam/2fa/confirm"}, handler: confirmTOTP, user: true, roles: sellerRoles},
+
+		{method: http.MethodGet, path: apiPrefix + "/admin/apikeys", aliases: []string{"/api/tanam/admin/apikey/list"}, handler: listAPIKeys, scope: "admin"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/apikeys", aliases: []string{"/api/tanam/admin/apikey/create"}, handler: createAPIKey, scope: "admin"},
+		{method: http.MethodDelete, path: apiPrefix + "/admin/apikeys/{id}", aliases: []string{"/api/tanam/admin/apikey/revoke"}, handler: revokeAPIKey, scope: "admin"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/products/{id}/moderation", aliases: []string{"/api/tanam/admin/product/moderate"}, handler: moderateProduct, user: true, roles: []string{RoleAdmin}},
+		{method: http.MethodPost, path: apiPrefix + "/admin/users/{id}/moderation", aliases: []string{"/api/tanam/admin/user/moderate"}, handler: moderateUser, user: true, roles: []string{RoleAdmin}},
+		{method: http.MethodPut, path: apiPrefix + "/admin/users/{id}/role", aliases: []string{"/api/tanam/admin/user/role"}, handler: setUserRole, user: true, roles: []string{RoleAdmin}},
+		{method: http.MethodDelete, path: apiPrefix + "/admin/users/{id}/2fa", aliases: []string{"/api/tanam/admin/user/2fa/reset"}, handler: resetTOTP, user: true, roles: []string{RoleAdmin}},
+	}
+}
+
+// pathID returns the numeric path wildcard name. ok is false on routes without the
+// wildcard, the legacy paths take the id from the body instead. An id that is not
+// a positive number comes back as 0 with ok set.
+func pathID(r *http.Request, name string) (id int, ok bool) {
+	value := r.PathValue(name)
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, true
+	}
+	return id, true
+}
+
+// chain wraps the handler of rt. From the outside in a request passes the timeout,
+// the body limit, gzip, the session and role checks, the API key and its scope and
+// finally the rate limit, which may be keyed by user or API key.
+func (rt route) chain() http.Handler {
+	var middlewares []func(http.Handler) http.Handler
+	if rt.rateLimit != nil {
+		middlewares = append(middlewares, RateLimitMiddleware(rt.rateLimit.name, rt.rateLimit.limit, rt.rateLimit.key))
+	}
+	if rt.scope != "" {
+		middlewares = append(middlewares, RequireScope(rt.scope))
+	}
+	if !rt.public {
+		middlewares = append(middlewares, APIKeyMiddleware)
+	}
+	if len(rt.roles) > 0 {
+		middlewares = append(middlewares, RequireRole(rt.roles...))
+	}
+	if rt.user {
+		middlewares = append(middlewares, JWTMiddleware)
+	}
+	if !rt.streaming {
+		middlewares = append(middlewares, GzipMiddleware)
+	}
+
+	maxBody := rt.maxBody
+	if maxBody == 0 {
+		maxBody = maxRequestBodySize
+	}
+	middlewares = append(middlewares, BodyLimitMiddleware(maxBody))
+
+	// Streamed responses only get the deadline of the server's WriteTimeout
+	if !rt.streaming {
+		timeout := rt.timeout
+		if timeout == 0 {
+			timeout = config.RequestTimeout
+		}
+		middlewares = append(middlewares, TimeoutMiddleware(timeout))
+	}
+	return ChainMiddleware(rt.handler, middlewares...)
+}
+
+// newAPIHandler registers routes on a fresh mux and wraps it in the middleware every
+// request passes. Tracing, request ids, metrics and the access log wrap everything so
+// requests rejected by any middleware are counted too.
+func newAPIHandler(routes []route, cfg Config) http.Handler {
+	mux := http.NewServeMux()
+	allowed := map[string][]string{} // methods registered per path
+	anyMethod := map[string]bool{}
+	for _, rt := range routes {
+		h := rt.chain()
+		for _, pattern := range append([]string{rt.method + " " + rt.path}, rt.aliases...) {
+			mux.Handle(pattern, h)
+			if method, path, ok := strings.Cut(pattern, " "); ok {
+				allowed[path] = append(allowed[path], method)
+			} else {
+				anyMethod[path] = true
+			}
+		}
+	}
+	// ServeMux answers unknown paths and known paths with the wrong method in plain
+	// text, these answer in the API's JSON error format instead
+	for path, methods := range allowed {
+		if !anyMethod[path] {
+			mux.Handle(path, methodNotAllowed(methods))
+		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, newAPIError(CodeNotFound, "Not found"))
+	})
+
+	middlewares := []func(http.Handler) http.Handler{}
+	// Not with a self-signed certificate, browsers would refuse plain HTTP to localhost for a year
+	if cfg.TLSMode == TLSFiles || cfg.TLSMode == TLSACME {
+		middlewares = append(middlewares, HSTSMiddleware(cfg.HSTSMaxAge))
+	}
+	if cfg.GlobalRateLimit > 0 {
+		// Global per IP budget on top of the per route limits
+		middlewares = append(middlewares, RateLimitMiddleware("global", PerMinute(cfg.GlobalRateLimit), RateLimitByIP))
+	}
+	middlewares = append(middlewares, MetricsMiddleware(mux), LoggingMiddleware, RequestIDMiddleware, TracingMiddleware(mux))
+
+	// Probes bypass the API key, rate limits and access log, they are polled every few
+	// seconds. readyz caches its checks, so frequent polling does not reach the dependencies
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", healthz)
+	root.HandleFunc("/readyz", readyz)
+	root.Handle("/", ChainMiddleware(mux, middlewares...))
+	return root
+}
+
+// methodNotAllowed answers requests to a path that exists with a method it does not
+// serve. GET routes serve HEAD too.
+func methodNotAllowed(methods []string) http.Handler {
+	if slices.Contains(methods, http.MethodGet) {
+		methods = append(methods, http.MethodHead)
+	}
+	slices.Sort(methods)
+	allow := strings.Join(slices.Compact(methods), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeError(w, errMethodNotAllowed)
+	})
+}
+
+// routePattern is the path of the pattern mux routes r to, without the method,
+// for metric labels and span names. Requests matching no route share "unmatched".
+func routePattern(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" || pattern == "/" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
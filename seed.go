@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"tanamdev/validation"
+)
+
+// ensureUser returns the id of the user with email, inserting it when missing.
+func ensureUser(ctx context.Context, db *sql.DB, name string, email string, password string, role string) (int64, bool, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM user WHERE user_email = ?", email).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, false, err
+	}
+	result, err := db.ExecContext(ctx, "INSERT INTO user (user_name, user_email, user_password, user_role) VALUES (?, ?, ?, ?)", name, email, hashedPassword, role)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err = result.LastInsertId()
+	return id, true, err
+}
+
+var seedProducts = []struct {
+	name, category, price, state, description string
+	quantity                                  int
+}{
+	{"Bibit Cabai Rawit", "Bibit", "15000", "new", "Bibit cabai rawit siap tanam, 10 batang.", 40},
+	{"Pupuk Kompos 5kg", "Pupuk", "25000", "new", "Kompos organik dari daun dan kotoran ternak.", 25},
+	{"Cangkul Bekas", "Alat", "60000", "used", "Cangkul baja, gagang kayu masih kokoh.", 2},
+}
+
+// runSeedCommand fills a development database with a buyer, a seller and some
+// products. Running it again adds nothing.
+func runSeedCommand(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	password := flags.String("password", "password123", "password of the seeded users")
+	force := flags.Bool("force", false, "seed even though TANAM_ENV is production")
+	flags.Parse(args)
+
+	if config.Env == EnvProduction && !*force {
+		log.Fatal("seed: refusing to seed a production database, set TANAM_ENV=development or pass -force")
+	}
+
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		log.Fatalf("seed: %v", err)
+	}
+
+	if _, _, err := ensureUser(ctx, db, "Demo Buyer", "buyer@example.com", *password, RoleBuyer); err != nil {
+		log.Fatalf("seed: %v", err)
+	}
+	sellerID, created, err := ensureUser(ctx, db, "Demo Seller", "seller@example.com", *password, RoleSeller)
+	if err != nil {
+		log.Fatalf("seed: %v", err)
+	}
+	if !created {
+		fmt.Println("Seed users already exist, nothing to do")
+		return
+	}
+
+	for _, p := range seedProducts {
+		_, err := db.ExecContext(ctx, "INSERT INTO product (product_name, product_category, product_price, product_quantity, product_state, product_description, seller_id, product_image_url) VALUES (?, ?, ?, ?, ?, ?, ?, '')",
+			p.name, p.category, p.price, p.quantity, p.state, p.description, sellerID)
+		if err != nil {
+			log.Fatalf("seed: %v", err)
+		}
+	}
+	invalidateProductCache(ctx)
+	fmt.Printf("Seeded buyer@example.com and seller@example.com with %d products\n", len(seedProducts))
+}
+
+// runCreateAdminCommand makes the user with -email an admin, creating the account
+// when there is none. The password is read from stdin so it stays out of the shell
+// history and process list.
+func runCreateAdminCommand(args []string) {
+	flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := flags.String("email", "", "email of the admin")
+	name := flags.String("name", "Admin", "name of a new admin account")
+	flags.Parse(args)
+
+	v := validation.New()
+	if v.Required("email", *email) {
+		v.Email("email", *email)
+	}
+	v.Length("name", *name, 1, maxNameLength)
+	if !v.Valid() {
+		log.Fatalf("create-admin: %v", v.Errors())
+	}
+
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		log.Fatalf("create-admin: %v", err)
+	}
+
+	var userID int64
+	err = db.QueryRowContext(ctx, "SELECT user_id FROM user WHERE user_email = ?", *email).Scan(&userID)
+	if err == nil {
+		if _, err := db.ExecContext(ctx, "UPDATE user SET user_role = ? WHERE user_id = ?", RoleAdmin, userID); err != nil {
+			log.Fatalf("create-admin: %v", err)
+		}
+		fmt.Printf("User %d (%s) is now an admin\n", userID, *email)
+		return
+	}
+	if err != sql.ErrNoRows {
+		log.Fatalf("create-admin: %v", err)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("create-admin: reading password: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		log.Fatalf("create-admin: password must be %d to %d bytes", minPasswordLength, maxPasswordLength)
+	}
+
+	userID, _, err = ensureUser(ctx, db, *name, *email, password, RoleAdmin)
+	if err != nil {
+		log.Fatalf("create-admin: %v", err)
+	}
+	fmt.Printf("Created admin %d (%s)\n", userID, *email)
+}
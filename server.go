@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+	serverMaxHeaderBytes    = 1 << 20
+
+	// Body limit of every route that does not upload files
+	maxRequestBodySize = 1 << 20
+)
+
+// newServer returns a server whose timeouts leave room for the slowest route, an
+// upload, but still drop clients that trickle in headers or sit on idle connections.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       config.UploadTimeout,
+		WriteTimeout:      config.UploadTimeout + 30*time.Second,
+		IdleTimeout:       serverIdleTimeout,
+		MaxHeaderBytes:    serverMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// BodyLimitMiddleware rejects request bodies larger than limit bytes. Reads past the
+// limit fail with an http.MaxBytesError, which writeError answers with a 413.
+func BodyLimitMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeError(w, &http.MaxBytesError{Limit: limit})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// backgroundWorkers tracks goroutines that must finish before the process exits,
+// such as the upload sweeper and emails sent after the response.
+var backgroundWorkers sync.WaitGroup
+
+func goBackground(f func()) {
+	backgroundWorkers.Add(1)
+	go func() {
+		defer backgroundWorkers.Done()
+		f()
+	}()
+}
+
+// managedServer is a server together with the call that starts it, ListenAndServe
+// or ListenAndServeTLS.
+type managedServer struct {
+	srv   *http.Server
+	serve func(*http.Server) error
+}
+
+func plainServer(srv *http.Server) managedServer {
+	return managedServer{srv: srv, serve: (*http.Server).ListenAndServe}
+}
+
+// tlsServer serves with the certificates of srv.TLSConfig.
+func tlsServer(srv *http.Server) managedServer {
+	return managedServer{srv: srv, serve: func(s *http.Server) error {
+		return s.ListenAndServeTLS("", "")
+	}}
+}
+
+// serveUntilSignal runs servers until SIGINT or SIGTERM arrives or one of them fails.
+// It then stops accepting connections, lets in-flight requests and background workers
+// finish within the shutdown timeout and closes the database pool and Redis client.
+// startWorkers gets a context that is cancelled when shutdown begins.
+func serveUntilSignal(servers []managedServer, startWorkers func(ctx context.Context)) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	if startWorkers != nil {
+		startWorkers(workerCtx)
+	}
+
+	failed := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s managedServer) {
+			slog.Info("starting server", "addr", s.srv.Addr)
+			if err := s.serve(s.srv); !errors.Is(err, http.ErrServerClosed) {
+				failed <- err
+			}
+		}(s)
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case serveErr = <-failed:
+		slog.Error("server failed, shutting down", "err", serveErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	stopWorkers()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("server did not drain in time", "addr", srv.Addr, "err", err)
+				srv.Close()
+			}
+		}(s.srv)
+	}
+	wg.Wait()
+
+	workersDone := make(chan struct{})
+	go func() {
+		backgroundWorkers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		slog.Warn("background workers did not finish in time")
+	}
+
+	closeDB()
+	if err := rdb.Close(); err != nil {
+		slog.Warn("failed to close redis client", "err", err)
+	}
+	return serveErr
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var urlSigningKey = deriveURLSigningKey()
+
+// deriveURLSigningKey never signs URLs with the JWT key itself, a URL signature
+// must not be usable as anything else.
+func deriveURLSigningKey() []byte {
+	if config.URLSigningKey != "" {
+		return []byte(config.URLSigningKey)
+	}
+	mac := hmac.New(sha256.New, jwtKey)
+	mac.Write([]byte("tanam image url signing"))
+	return mac.Sum(nil)
+}
+
+func imageURLSignature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, urlSigningKey)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signImageURL returns a loadImage URL for key that stops working at expires.
+func signImageURL(key string, expires time.Time) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", imageURLSignature(key, expires.Unix()))
+	return imageURL(key) + "?" + q.Encode()
+}
+
+// verifyImageURL checks the expires and sig query values loadImage received for key.
+func verifyImageURL(key string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	sig := query.Get("sig")
+	return hmac.Equal([]byte(sig), []byte(imageURLSignature(key, expires)))
+}
+
+// presentImageURL turns a stored image URL into one a client can load. Private
+// blobs get a signed URL. The expiry is rounded to the TTL so the same URL is
+// handed out for a while and clients can still cache the image.
+func presentImageURL(stored string) string {
+	if stored == "" {
+		return stored
+	}
+	key := blobKeyFromURL(stored)
+	if !blobPrivate(key) {
+		return stored
+	}
+	ttl := config.SignedURLTTL
+	return signImageURL(key, time.Now().Truncate(ttl).Add(2*ttl))
+}
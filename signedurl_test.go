@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedQuery(t *testing.T, key string, expires time.Time) url.Values {
+	t.Helper()
+	u, err := url.Parse(signImageURL(key, expires))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := blobKeyFromURL(u.Path); got != key {
+		t.Fatalf("signed URL %s is for key %q, want %q", u, got, key)
+	}
+	return u.Query()
+}
+
+func TestVerifyImageURL(t *testing.T) {
+	const key = "private/3a7b.jpg"
+	valid := signedQuery(t, key, time.Now().Add(time.Hour))
+	if !verifyImageURL(key, valid) {
+		t.Fatal("valid signed URL rejected")
+	}
+
+	tampered := func(name string, value string) url.Values {
+		q := url.Values{}
+		for k, v := range valid {
+			q[k] = v
+		}
+		q.Set(name, value)
+		return q
+	}
+	later := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+	sig := valid.Get("sig")
+	flipped := string(sig[0]^1) + sig[1:]
+
+	tests := []struct {
+		name  string
+		key   string
+		query url.Values
+	}{
+		{"expired", key, signedQuery(t, key, time.Now().Add(-time.Second))},
+		{"extended expiry", key, tampered("expires", later)},
+		{"changed signature", key, tampered("sig", flipped)},
+		{"other key", "private/other.jpg", valid},
+		{"no signature", key, tampered("sig", "")},
+		{"no expiry", key, tampered("expires", "")},
+		{"malformed expiry", key, tampered("expires", "soon")},
+	}
+	for _, tt := range tests {
+		if verifyImageURL(tt.key, tt.query) {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestPresentImageURL(t *testing.T) {
+	public := imageURL("3a7b.jpg")
+	if got := presentImageURL(public); got != public {
+		t.Errorf("public URL changed to %s", got)
+	}
+	if got := presentImageURL(""); got != "" {
+		t.Errorf("empty URL changed to %s", got)
+	}
+
+	presented := presentImageURL(imageURL("private/3a7b.jpg"))
+	u, err := url.Parse(presented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyImageURL("private/3a7b.jpg", u.Query()) {
+		t.Errorf("presented URL %s does not verify", presented)
+	}
+}
+
+// loadImage only serves private blobs through a valid signature.
+func TestLoadImagePrivate(t *testing.T) {
+	useTestBlobStore(t, newLocalBlobStore(t.TempDir()))
+	if err := blobStore.Put(context.Background(), "private/photo.png", []byte("png"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		loadImage(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+	path := strings.TrimPrefix(imageURL("private/photo.png"), config.PublicBaseURL)
+	if code := get(path); code != http.StatusForbidden {
+		t.Errorf("unsigned: status %d, want 403", code)
+	}
+	signed := signedQuery(t, "private/photo.png", time.Now().Add(time.Minute))
+	if code := get(path + "?" + signed.Encode()); code != http.StatusOK {
+		t.Errorf("signed: status %d, want 200", code)
+	}
+}
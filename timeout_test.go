@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutMiddlewarePassesThrough(t *testing.T) {
+	handler := TimeoutMiddleware(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/api/tanam/v1/products/7")
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusTeapot) // ignored like on a real ResponseWriter
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusCreated {
+		t.Errorf("status %d, want 201", w.Code)
+	}
+	if w.Header().Get("Location") != "/api/tanam/v1/products/7" || w.Header().Get("X-Request-ID") != "req-1" {
+		t.Errorf("headers = %v", w.Header())
+	}
+	if w.Body.String() != `{"status":"success"}` {
+		t.Errorf("body = %s", w.Body)
+	}
+}
+
+func TestTimeoutMiddlewareDeadline(t *testing.T) {
+	release := make(chan struct{})
+	lateWrite := make(chan error, 1)
+	handler := TimeoutMiddleware(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A handler that does not watch its context
+		<-release
+		w.Header().Set("X-Late", "1")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write([]byte("late"))
+		lateWrite <- err
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	close(release)
+	if err := <-lateWrite; err != http.ErrHandlerTimeout {
+		t.Errorf("late write returned %v, want http.ErrHandlerTimeout", err)
+	}
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", w.Code)
+	}
+	if w.Header().Get("X-Late") != "" {
+		t.Error("header set after the deadline reached the client")
+	}
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body, err)
+	}
+	if resp.Error == nil || resp.Error.Code != CodeTimeout {
+		t.Errorf("body = %s", w.Body)
+	}
+}
+
+// A handler that notices its context ended too late still only produces the 504.
+func TestTimeoutMiddlewareAnswerAfterDeadline(t *testing.T) {
+	handler := TimeoutMiddleware(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		writeError(w, errInternal)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", w.Code)
+	}
+}
+
+func TestTimeoutMiddlewarePanic(t *testing.T) {
+	handler := TimeoutMiddleware(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recovered %v, want the handler's panic", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Error("panic swallowed")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Values of Config.TLSMode
+const (
+	TLSOff        = "off"         // plain HTTP only, e.g. behind a terminating proxy
+	TLSFiles      = "files"       // certificate and key files, reloaded when they change
+	TLSACME       = "acme"        // certificates obtained and renewed through ACME
+	TLSSelfSigned = "self-signed" // a throwaway certificate for localhost, development only
+)
+
+// certReloader serves the certificate in certFile and keyFile and picks up a renewed
+// one without a restart. The files are checked at most every certCheckInterval,
+// during a handshake, so no watcher goroutine is needed.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// certModTime is the later modification time of both files, certbot replaces them one at a time.
+func (c *certReloader) certModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.certModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) >= certCheckInterval {
+		c.checkedAt = time.Now()
+		modTime, err := c.certModTime()
+		if err == nil && !modTime.Equal(c.modTime) {
+			// A half written pair fails to load, keep serving the old one until the next check
+			if err := c.load(); err != nil {
+				slog.Error("failed to reload tls certificate", "err", err)
+			} else {
+				slog.Info("tls certificate reloaded", "file", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// selfSignedCertificate makes a certificate for localhost that lives as long as the process.
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"tanam development"}},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newTLSConfig returns the TLS config of the API listener for cfg.TLSMode and the
+// handler of the plain HTTP listener, which redirects to HTTPS and with ACME also
+// answers the http-01 challenges. ACME can only validate a domain when the plain
+// listener is reachable on port 80 or the TLS one on port 443.
+func newTLSConfig(cfg Config) (*tls.Config, http.Handler, error) {
+	redirect := redirectToHTTPS(cfg.HTTPSAddr)
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch cfg.TLSMode {
+	case TLSFiles:
+		reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		return tlsConfig, redirect, nil
+	case TLSACME:
+		if len(cfg.ACMEDomains) == 0 {
+			return nil, nil, fmt.Errorf("TANAM_ACME_DOMAINS is required with TLS mode acme")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			Email:      cfg.ACMEEmail,
+		}
+		acmeConfig := manager.TLSConfig()
+		acmeConfig.MinVersion = tls.VersionTLS12
+		return acmeConfig, manager.HTTPHandler(redirect), nil
+	case TLSSelfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+		return tlsConfig, redirect, nil
+	}
+	return nil, nil, fmt.Errorf("unknown TLS mode %q", cfg.TLSMode)
+}
+
+// redirectToHTTPS sends clients to the same host, path and query on the HTTPS
+// listener. 308 keeps the method and body, a 301 would turn a POST into a GET.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// HSTSMiddleware tells browsers to only use HTTPS for this host from now on. It is
+// only set on TLS responses, browsers ignore it over plain HTTP anyway.
+func HSTSMiddleware(maxAge time.Duration) func(http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		method    string
+		host      string
+		target    string
+		want      string
+	}{
+		{":8488", http.MethodGet, "api.tanam.software", "/api/tanam/v1/products?page=2", "https://api.tanam.software:8488/api/tanam/v1/products?page=2"},
+		{":8488", http.MethodGet, "api.tanam.software:8081", "/healthz", "https://api.tanam.software:8488/healthz"},
+		{":443", http.MethodGet, "api.tanam.software:8081", "/healthz", "https://api.tanam.software/healthz"},
+		{"0.0.0.0:443", http.MethodPost, "api.tanam.software", "/api/tanam/v1/login", "https://api.tanam.software/api/tanam/v1/login"},
+		{":8488", http.MethodGet, "[::1]:8081", "/x", "https://[::1]:8488/x"},
+		{":443", http.MethodGet, "[::1]:8081", "/x", "https://[::1]/x"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.httpsAddr).ServeHTTP(w, r)
+
+		// 308 so clients repeat a POST with its body instead of switching to GET
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s %s%s: status %d, want 308", tt.method, tt.host, tt.target, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s %s%s: Location = %q, want %q", tt.method, tt.host, tt.target, got, tt.want)
+		}
+	}
+}
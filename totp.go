@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer        = "Tanam"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of now, for clock drift
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode implements RFC 6238 with the defaults authenticator apps expect (SHA1, 6 digits, 30s).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validateTOTP returns the time step the code matched so callers can refuse replays.
+func validateTOTP(secret string, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(email string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func createMFAToken(user User) (string, time.Time, error) {
+	expirationTime := time.Now().Add(mfaTokenTTL)
+	claims := &Claims{
+		Email:   user.Email,
+		UserID:  user.ID,
+		Role:    user.Role,
+		Purpose: "mfa",
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtKey)
+	return tokenString, expirationTime, err
+}
+
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var enabled bool
+	err = db.QueryRowContext(r.Context(), "SELECT user_totp_enabled FROM user WHERE user_id = ?", claims.UserID).Scan(&enabled)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if enabled {
+		writeError(w, newAPIError(CodeConflict, "Two-factor authentication already enabled"))
+		return
+	}
+
+	// The secret stays pending until confirmTOTP proves the app was set up
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to generate totp secret", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	_, err = db.ExecContext(r.Context(), "UPDATE user SET user_totp_secret = ? WHERE user_id = ?", secret, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to store totp secret", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	uri := totpURI(claims.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode totp qr code", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: map[string]string{
+		"otpauth_uri": uri,
+		"secret":      secret,
+		"qr_png":      base64.StdEncoding.EncodeToString(png),
+	}})
+}
+
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		slog.WarnContext(r.Context(), "parsing form error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
+		return
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	err = db.QueryRowContext(r.Context(), "SELECT user_totp_secret, user_totp_enabled FROM user WHERE user_id = ?", claims.UserID).Scan(&secret, &enabled)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if enabled {
+		writeError(w, newAPIError(CodeConflict, "Two-factor authentication already enabled"))
+		return
+	}
+	if !secret.Valid {
+		writeError(w, newAPIError(CodeBadRequest, "Two-factor enrollment not started"))
+		return
+	}
+	if _, ok := validateTOTP(secret.String, code, time.Now()); !ok {
+		writeError(w, newAPIError(CodeInvalidCredentials, "Invalid code"))
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to generate recovery codes", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to begin transaction", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(r.Context(), "DELETE FROM user_recovery_code WHERE user_id = ?", claims.UserID)
+	if err == nil {
+		for _, c := range codes {
+			_, err = tx.ExecContext(r.Context(), "INSERT INTO user_recovery_code (user_id, recovery_code_hash) VALUES (?, ?)", claims.UserID, hashRecoveryCode(c))
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), "UPDATE user SET user_totp_enabled = 1 WHERE user_id = ?", claims.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to enable totp", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	// Recovery codes are only shown once, only their hashes are kept
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: map[string][]string{"recovery_codes": codes}})
+}
+
+// loginTOTPHandler finishes a login started by loginHandler for users with 2FA enabled.
+// It takes the mfa_token from that response plus either a code or a recovery_code.
+func loginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		slog.WarnContext(r.Context(), "parsing form error", "err", err)
+		writeError(w, bodyError(err, errInvalidForm))
+		return
+	}
+
+	mfaToken := r.FormValue("mfa_token")
+	code := r.FormValue("code")
+	recoveryCode := r.FormValue("recovery_code")
+	if mfaToken == "" || (code == "" && recoveryCode == "") {
+		writeError(w, errInvalidForm)
+		return
+	}
+
+	claims := &Claims{}
+	tkn, err := jwt.ParseWithClaims(mfaToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil || !tkn.Valid || claims.Purpose != "mfa" {
+		writeError(w, newAPIError(CodeUnauthorized, "Invalid or expired mfa token"))
+		return
+	}
+
+	exceeded, err := loginAttemptsExceeded(r.Context(), claims.Email)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to check login attempts", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if exceeded {
+		loginLockouts.WithLabelValues("2fa").Inc()
+		writeError(w, newAPIError(CodeRateLimited, "Maximum login attempts exceeded"))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	var user User
+	var status string
+	var secret sql.NullString
+	var enabled bool
+	err = db.QueryRowContext(r.Context(), "SELECT user_id, user_email, user_name, user_role, user_status, user_totp_secret, user_totp_enabled FROM user WHERE user_id = ?", claims.UserID).
+		Scan(&user.ID, &user.Email, &user.Name, &user.Role, &status, &secret, &enabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errInvalidCredentials)
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to fetch user", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if status == UserStatusBanned {
+		writeError(w, errAccountBanned)
+		return
+	}
+	if !enabled || !secret.Valid {
+		// 2FA was reset after the mfa token was issued, the password step has to be redone
+		writeError(w, newAPIError(CodeUnauthorized, "Invalid or expired mfa token"))
+		return
+	}
+
+	if code != "" {
+		step, ok := validateTOTP(secret.String, code, time.Now())
+		if !ok {
+			writeError(w, newAPIError(CodeInvalidCredentials, "Invalid code"))
+			return
+		}
+		// A code can only be used once inside its validity window
+		fresh, err := rdb.SetNX(r.Context(), fmt.Sprintf("totp_used:%s:%d", user.ID, step), 1, (2*totpSkew+1)*totpPeriod*time.Second).Result()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to record totp use", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+		if !fresh {
+			writeError(w, newAPIError(CodeInvalidCredentials, "Invalid code"))
+			return
+		}
+	} else {
+		result, err := db.ExecContext(r.Context(), "UPDATE user_recovery_code SET recovery_code_used_at = ? WHERE user_id = ? AND recovery_code_hash = ? AND recovery_code_used_at IS NULL", time.Now().UTC(), user.ID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to use recovery code", "err", err)
+			writeError(w, errInternal)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected != 1 {
+			writeError(w, newAPIError(CodeInvalidCredentials, "Invalid recovery code"))
+			return
+		}
+	}
+
+	resetAttempts(r.Context(), user.Email)
+
+	if err := issueSession(w, user); err != nil {
+		slog.ErrorContext(r.Context(), "create token error", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: user})
+}
+
+func resetTOTP(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if userID, ok := pathID(r, "id"); ok {
+		req.UserID = userID
+		if req.UserID == 0 {
+			writeError(w, newAPIError(CodeNotFound, "User not found"))
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		writeError(w, bodyError(err, errInvalidJSON))
+		return
+	}
+
+	db, err := dbConnect(r.Context(), w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "dbconnect error", "err", err)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "UPDATE user SET user_totp_secret = NULL, user_totp_enabled = 0 WHERE user_id = ?", req.UserID)
+	if err == nil {
+		_, err = db.ExecContext(r.Context(), "DELETE FROM user_recovery_code WHERE user_id = ?", req.UserID)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to reset totp", "err", err)
+		writeError(w, errInternal)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Two-factor authentication was not enabled"})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, Response{Status: "success", Data: "Two-factor authentication reset"})
+}
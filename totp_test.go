@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 seed of RFC 6238 appendix B, "12345678901234567890", in base32.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// RFC 6238 appendix B lists 8 digit codes, a 6 digit code is their last 6 digits.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode at %d: %v", tt.unix, err)
+		}
+		if want := tt.want[len(tt.want)-totpDigits:]; got != want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestTOTPCodeSecretCase(t *testing.T) {
+	upper, err := totpCode(rfc6238Secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower, err := totpCode(strings.ToLower(rfc6238Secret), 1)
+	if err != nil || lower != upper {
+		t.Errorf("lower case secret gave %q, %v, want %q", lower, err, upper)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	codeAt := func(step int64) string {
+		code, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	for _, offset := range []int64{-totpSkew, 0, totpSkew} {
+		step, ok := validateTOTP(rfc6238Secret, codeAt(current+offset), now)
+		if !ok || step != current+offset {
+			t.Errorf("code %d steps away: step %d, ok %v", offset, step, ok)
+		}
+	}
+	for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+		if _, ok := validateTOTP(rfc6238Secret, codeAt(current+offset), now); ok {
+			t.Errorf("code %d steps away accepted", offset)
+		}
+	}
+	for _, code := range []string{"", "12345", "1234567", codeAt(current) + "0"} {
+		if _, ok := validateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxUploadSize = 10 << 20
+	// Body limits of the upload routes, with room for the text fields and multipart framing
+	maxProductUploadBody = maxProductImages*maxUploadSize + 1<<20
+	maxPhotoUploadBody   = maxUploadSize + 1<<20
+	maxImageDimension    = 8000
+	maxImagePixelCount   = 40_000_000
+)
+
+// allowedImageTypes maps the sniffed content type to the extension files are stored with.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+var (
+	errUploadTooLarge   = newAPIError(CodePayloadTooLarge, fmt.Sprintf("Image must be at most %d MB", maxUploadSize>>20))
+	errUploadType       = newAPIError(CodeUnsupportedMedia, "Image must be a JPEG, PNG or WebP file")
+	errUploadCorrupt    = newAPIError(CodeBadRequest, "Image file is corrupt or not an image")
+	errUploadDimensions = newAPIError(CodeBadRequest, fmt.Sprintf("Image must be at most %dx%d pixels", maxImageDimension, maxImageDimension))
+)
+
+// validatedUpload is an image that passed validateUpload and can be stored.
+type validatedUpload struct {
+	Data        []byte
+	ContentType string
+	Image       image.Image
+}
+
+// readUpload reads an uploaded file and checks that it really is an image we accept,
+// judging type and dimensions by the image header without decoding any pixels.
+// The declared filename and content type are ignored, only the bytes are trusted.
+func readUpload(file multipart.File, header *multipart.FileHeader) (data []byte, contentType string, err error) {
+	if header.Size > maxUploadSize {
+		return nil, "", errUploadTooLarge
+	}
+	data, err = io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxUploadSize {
+		return nil, "", errUploadTooLarge
+	}
+
+	contentType = http.DetectContentType(data)
+	if _, ok := allowedImageTypes[contentType]; !ok {
+		return nil, "", errUploadType
+	}
+
+	// Check the header so a tiny file claiming huge dimensions is never decoded
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != contentType {
+		return nil, "", errUploadCorrupt
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > maxImageDimension || config.Height > maxImageDimension || config.Width*config.Height > maxImagePixelCount {
+		return nil, "", errUploadDimensions
+	}
+	return data, contentType, nil
+}
+
+// validateUpload reads and decodes an uploaded image. A decoded image at the pixel
+// limit takes well over 100 MB, so requests with several images validate and stage
+// them one at a time, see stageUploads.
+func validateUpload(file multipart.File, header *multipart.FileHeader) (*validatedUpload, error) {
+	data, contentType, err := readUpload(file, header)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUploadCorrupt
+	}
+	return &validatedUpload{Data: data, ContentType: contentType, Image: img}, nil
+}
+
+// stagingPrefix holds uploads whose database row is not committed yet. The upload
+// GC removes whatever a crashed request left behind there.
+const stagingPrefix = "staging/"
+
+// stagedUpload is an image and its resized variants written to a staging key.
+// Exactly one of promote or discard is called once the outcome is known.
+type stagedUpload struct {
+	URL    string // where the image is served after promote
+	keys   []string
+	staged []string
+}
+
+// stageUpload writes a validated image and its resized variants to a staging area
+// of the blob store. URL is the full size image, see loadImage for selecting a
+// variant. The URL of a private upload only works after presentImageURL signed it.
+func stageUpload(ctx context.Context, upload *validatedUpload, visibility BlobVisibility) (*stagedUpload, error) {
+	images, err := processUpload(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	dir := stagingPrefix + hex.EncodeToString(id) + "/"
+
+	staged := &stagedUpload{URL: imageURL(blobKey(images[0].Name, visibility))}
+	// Variants first, so once the main blob is promoted everything it refers to exists too
+	for i := len(images) - 1; i >= 0; i-- {
+		key := blobKey(images[i].Name, visibility)
+		if err := blobStore.Put(ctx, dir+key, images[i].Data, images[i].ContentType); err != nil {
+			staged.discard(ctx)
+			return nil, err
+		}
+		staged.keys = append(staged.keys, key)
+		staged.staged = append(staged.staged, dir+key)
+	}
+	return staged, nil
+}
+
+// promote moves the staged blobs to their final keys. Identical uploads with the
+// same visibility share the same blobs, moving over an existing one also refreshes
+// its modification time so the upload GC does not take it while it is referenced again.
+func (s *stagedUpload) promote(ctx context.Context) error {
+	for i := range s.staged {
+		if err := blobStore.Move(ctx, s.staged[i], s.keys[i]); err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "file uploaded", "key", s.keys[len(s.keys)-1], "variants", len(s.keys)-1)
+	return nil
+}
+
+// discard removes what is left in staging. Failures are only logged, the upload GC
+// cleans up after them.
+func (s *stagedUpload) discard(ctx context.Context) {
+	for _, key := range s.staged {
+		if err := blobStore.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "failed to discard staged upload", "key", key, "err", err)
+		}
+	}
+}
+
+// storeUpload stages and promotes in one go, for uploads that do not depend on a transaction.
+func storeUpload(ctx context.Context, upload *validatedUpload, visibility BlobVisibility) (string, error) {
+	staged, err := stageUpload(ctx, upload, visibility)
+	if err != nil {
+		return "", err
+	}
+	if err := staged.promote(ctx); err != nil {
+		staged.discard(ctx)
+		return "", err
+	}
+	return staged.URL, nil
+}
+
+// saveUpload validates and stores an uploaded image in one go.
+func saveUpload(ctx context.Context, file multipart.File, header *multipart.FileHeader, visibility BlobVisibility) (string, error) {
+	upload, err := validateUpload(file, header)
+	if err != nil {
+		return "", err
+	}
+	return storeUpload(ctx, upload, visibility)
+}
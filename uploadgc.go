@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// UploadGCReport is what one garbage collection pass found and did.
+type UploadGCReport struct {
+	Scanned      int      `json:"scanned"`
+	Referenced   int      `json:"referenced"`
+	InGrace      int      `json:"in_grace"`
+	Removed      []string `json:"removed"`
+	RemovedBytes int64    `json:"removed_bytes"`
+	Failed       int      `json:"failed"`
+	DryRun       bool     `json:"dry_run"`
+}
+
+const uploadGCLockKey = "upload_gc_lock"
+
+var variantSuffix = regexp.MustCompile(`_w[0-9]+$`)
+
+// originalBlobKey maps a resized variant back to the image it was made from,
+// abc_w400.jpg becomes abc.jpg. Other keys are returned unchanged.
+func originalBlobKey(key string) string {
+	ext := path.Ext(key)
+	return variantSuffix.ReplaceAllString(strings.TrimSuffix(key, ext), "") + ext
+}
+
+// uploadReferences returns the key of every blob some row still points at.
+// Hidden and removed products keep their images, moderation can undo both.
+func uploadReferences(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	queries := []string{
+		"SELECT product_image_url FROM product WHERE product_image_url IS NOT NULL AND product_image_url <> ''",
+		"SELECT product_image_url FROM product_image",
+		"SELECT user_photo FROM user WHERE user_photo IS NOT NULL AND user_photo <> ''",
+	}
+
+	refs := make(map[string]bool)
+	for _, query := range queries {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var url string
+			if err := rows.Scan(&url); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			refs[blobKeyFromURL(url)] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// collectOrphanUploads deletes blobs no row refers to. A variant lives and dies with
+// its original. Anything younger than grace is kept, which covers uploads whose row
+// is not committed yet. Promoting an upload rewrites an existing blob it reuses, so reusing
+// an orphan also puts it back into its grace period.
+func collectOrphanUploads(ctx context.Context, db *sql.DB, grace time.Duration, dryRun bool) (UploadGCReport, error) {
+	// References are read before listing, a blob referenced in between is new and in its grace period
+	refs, err := uploadReferences(ctx, db)
+	if err != nil {
+		return UploadGCReport{Removed: []string{}, DryRun: dryRun}, err
+	}
+	return sweepUploads(ctx, refs, grace, dryRun)
+}
+
+// sweepUploads is collectOrphanUploads once the references are known.
+func sweepUploads(ctx context.Context, refs map[string]bool, grace time.Duration, dryRun bool) (UploadGCReport, error) {
+	report := UploadGCReport{Removed: []string{}, DryRun: dryRun}
+
+	var blobs []BlobInfo
+	modTimes := make(map[string]time.Time)
+	err := blobStore.List(ctx, "", func(info BlobInfo) error {
+		blobs = append(blobs, info)
+		modTimes[info.Key] = info.ModTime
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(blobs)
+
+	// An empty reference set next to a non empty store is far more likely a wrong
+	// database than a marketplace without a single image
+	if len(refs) == 0 && len(blobs) > 0 {
+		return report, errors.New("no upload references found, refusing to delete every upload")
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, blob := range blobs {
+		original := originalBlobKey(blob.Key)
+		if refs[original] || refs[blob.Key] {
+			report.Referenced++
+			continue
+		}
+		modTime := blob.ModTime
+		if t, ok := modTimes[original]; ok && t.After(modTime) {
+			modTime = t
+		}
+		if modTime.After(cutoff) {
+			report.InGrace++
+			continue
+		}
+
+		if !dryRun {
+			// A promote that reused the blob after List rewrote it, judge its age again
+			// right before deleting so a blob a new row points to is not taken. S3 lists
+			// modification times in milliseconds but stats them in seconds.
+			current, err := blobStore.Stat(ctx, blob.Key)
+			if err == errBlobNotFound {
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "upload gc failed to stat", "key", blob.Key, "err", err)
+				report.Failed++
+				continue
+			}
+			if !current.ModTime.Truncate(time.Second).Equal(blob.ModTime.Truncate(time.Second)) || current.ModTime.After(cutoff) {
+				report.InGrace++
+				continue
+			}
+			if err := blobStore.Delete(ctx, blob.Key); err != nil {
+				slog.ErrorContext(ctx, "upload gc failed to delete", "key", blob.Key, "err", err)
+				report.Failed++
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, blob.Key)
+		report.RemovedBytes += blob.Size
+	}
+	return report, nil
+}
+
+// deleteUnreferencedUploads removes the blobs behind urls, with their variants, once no
+// row points at them anymore. Identical uploads share a blob, so one still referenced by
+// another row is kept. A blob written within grace may have just been reused by an upload
+// whose row is not committed yet, it is left to the sweeper, which removes it after grace.
+func deleteUnreferencedUploads(ctx context.Context, db *sql.DB, urls []string, grace time.Duration) error {
+	refs, err := uploadReferences(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		key := blobKeyFromURL(url)
+		if refs[key] {
+			continue
+		}
+		info, err := blobStore.Stat(ctx, key)
+		if err != nil && err != errBlobNotFound {
+			slog.ErrorContext(ctx, "failed to stat upload", "key", key, "err", err)
+			continue
+		}
+		if err == nil && info.ModTime.After(cutoff) {
+			continue
+		}
+		keys := []string{key}
+		for _, width := range imageVariantWidths {
+			keys = append(keys, variantName(key, width))
+		}
+		for _, k := range keys {
+			if err := blobStore.Delete(ctx, k); err != nil {
+				slog.ErrorContext(ctx, "failed to delete upload", "key", k, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+func logUploadGCReport(report UploadGCReport) {
+	verb := "removed"
+	if report.DryRun {
+		verb = "would remove"
+	}
+	for _, key := range report.Removed {
+		slog.Info("upload gc "+verb, "key", key)
+	}
+	slog.Info("upload gc finished", "dry_run", report.DryRun, "scanned", report.Scanned, "referenced", report.Referenced,
+		"in_grace", report.InGrace, "removed", len(report.Removed), "removed_bytes", report.RemovedBytes, "failed", report.Failed)
+}
+
+// runUploadGC is one sweep as done by the background sweeper. The redis lock keeps
+// several instances from sweeping the same store at the same time.
+func runUploadGC(ctx context.Context, grace time.Duration) {
+	locked, err := rdb.SetNX(ctx, uploadGCLockKey, 1, time.Hour).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "upload GC lock error", "err", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer rdb.Del(ctx, uploadGCLockKey)
+
+	db, err := openDB(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "upload GC", "err", err)
+		return
+	}
+
+	report, err := collectOrphanUploads(ctx, db, grace, false)
+	if err != nil {
+		slog.ErrorContext(ctx, "upload GC failed", "err", err)
+		return
+	}
+	logUploadGCReport(report)
+}
+
+// startUploadGC sweeps orphaned uploads every interval until ctx is done.
+func startUploadGC(ctx context.Context, interval time.Duration, grace time.Duration) {
+	goBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runUploadGC(ctx, grace)
+			}
+		}
+	})
+}
+
+func runUploadGCCommand(args []string) {
+	fs := flag.NewFlagSet("gc-uploads", flag.ExitOnError)
+	grace := fs.Duration("grace", config.UploadGCGrace, "keep orphans younger than this")
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	fs.Parse(args)
+
+	db, err := openDB(context.Background())
+	if err != nil {
+		log.Fatalf("gc-uploads: %v", err)
+	}
+
+	report, err := collectOrphanUploads(context.Background(), db, *grace, *dryRun)
+	if err != nil {
+		log.Fatalf("gc-uploads: %v", err)
+	}
+	logUploadGCReport(report)
+	if *dryRun {
+		fmt.Printf("%d orphaned uploads would be removed, %d bytes\n", len(report.Removed), report.RemovedBytes)
+		return
+	}
+	fmt.Printf("%d orphaned uploads removed, %d bytes freed\n", len(report.Removed), report.RemovedBytes)
+}
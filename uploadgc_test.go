@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listHookStore runs afterList once List is done, to change the store between the
+// listing and the deletes of a sweep.
+type listHookStore struct {
+	BlobStore
+	afterList func()
+}
+
+func (s *listHookStore) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	err := s.BlobStore.List(ctx, prefix, fn)
+	if s.afterList != nil {
+		s.afterList()
+	}
+	return err
+}
+
+func TestSweepUploads(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	local := newLocalBlobStore(root)
+	store := &listHookStore{BlobStore: local}
+	useTestBlobStore(t, store)
+
+	grace := time.Hour
+	old := time.Now().Add(-2 * grace)
+	put := func(key string, modTime time.Time) {
+		t.Helper()
+		if err := local.Put(ctx, key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("ref.jpg", old)
+	put("ref_w400.jpg", old)
+	put("private/ref.jpg", old)
+	put("fresh.jpg", time.Now())
+	put("fresh_w400.jpg", old) // kept as long as its original is
+	put("orphan.jpg", old)
+	put("orphan_w200.jpg", old)
+	put("staging/0a/crashed.jpg", old)
+	put("staging/0b/pending.jpg", time.Now())
+	put("rewritten.jpg", old)
+	refs := map[string]bool{"ref.jpg": true, "private/ref.jpg": true}
+
+	report, err := sweepUploads(ctx, refs, grace, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "orphan.jpg,orphan_w200.jpg,rewritten.jpg,staging/0a/crashed.jpg"
+	if got := sortedKeys(report.Removed); got != want {
+		t.Errorf("dry run would remove %s, want %s", got, want)
+	}
+	if _, err := local.Stat(ctx, "orphan.jpg"); err != nil {
+		t.Errorf("dry run deleted: %v", err)
+	}
+
+	// A promote reusing rewritten.jpg after the listing, still past the grace period by its time stamp
+	store.afterList = func() { put("rewritten.jpg", old.Add(time.Minute)) }
+	report, err = sweepUploads(ctx, refs, grace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "orphan.jpg,orphan_w200.jpg,staging/0a/crashed.jpg"; sortedKeys(report.Removed) != want {
+		t.Errorf("removed %v, want %s", report.Removed, want)
+	}
+	if report.Scanned != 10 || report.Referenced != 3 || report.InGrace != 4 || report.Failed != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	for _, key := range []string{"ref.jpg", "ref_w400.jpg", "private/ref.jpg", "fresh.jpg", "fresh_w400.jpg", "staging/0b/pending.jpg", "rewritten.jpg"} {
+		if _, err := local.Stat(ctx, key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	for _, key := range []string{"orphan.jpg", "orphan_w200.jpg", "staging/0a/crashed.jpg"} {
+		if _, err := local.Stat(ctx, key); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("%s not removed: %v", key, err)
+		}
+	}
+}
+
+func TestSweepUploadsWithoutReferences(t *testing.T) {
+	useTestBlobStore(t, newLocalBlobStore(t.TempDir()))
+	if err := blobStore.Put(context.Background(), "a.jpg", []byte("a"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sweepUploads(context.Background(), map[string]bool{}, 0, false); err == nil {
+		t.Error("sweep with no references at all did not refuse")
+	}
+}
+
+func sortedKeys(keys []string) string {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
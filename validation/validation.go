@@ -0,0 +1,120 @@
+// Package validation checks request fields and collects one message per invalid
+// field, so a client can show every problem next to the field it belongs to.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors is the list of invalid fields in the order they were checked.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validator records the first failed check of every field. Checks on a field that
+// already failed are skipped, so Required followed by Email reports only one of them.
+type Validator struct {
+	errs Errors
+}
+
+func New() *Validator {
+	return &Validator{}
+}
+
+func (v *Validator) failed(field string) bool {
+	for _, fe := range v.errs {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Check records message for field when ok is false.
+func (v *Validator) Check(ok bool, field string, message string) bool {
+	if ok || v.failed(field) {
+		return ok
+	}
+	v.errs = append(v.errs, FieldError{Field: field, Message: message})
+	return false
+}
+
+func (v *Validator) Required(field string, value string) bool {
+	return v.Check(strings.TrimSpace(value) != "", field, "is required")
+}
+
+// Length checks the length in characters, max 0 means no upper bound.
+func (v *Validator) Length(field string, value string, min int, max int) bool {
+	n := utf8.RuneCountInString(value)
+	if max > 0 && n > max {
+		return v.Check(false, field, fmt.Sprintf("must be at most %d characters", max))
+	}
+	return v.Check(n >= min, field, fmt.Sprintf("must be at least %d characters", min))
+}
+
+// Email accepts a bare address like user@example.com, no display name.
+func (v *Validator) Email(field string, value string) bool {
+	addr, err := mail.ParseAddress(value)
+	ok := err == nil && addr.Address == value && strings.Contains(value[strings.LastIndex(value, "@")+1:], ".")
+	return v.Check(ok, field, "must be a valid email address")
+}
+
+// Int parses value and checks min <= value <= max. It returns 0 when the check failed.
+func (v *Validator) Int(field string, value string, min int, max int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if !v.Check(err == nil, field, "must be a whole number") {
+		return 0
+	}
+	if !v.Check(n >= min && n <= max, field, fmt.Sprintf("must be between %d and %d", min, max)) {
+		return 0
+	}
+	return n
+}
+
+// Float parses value and checks min <= value <= max. It returns 0 when the check failed.
+func (v *Validator) Float(field string, value string, min float64, max float64) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if !v.Check(err == nil, field, "must be a number") {
+		return 0
+	}
+	if !v.Check(f >= min && f <= max, field, fmt.Sprintf("must be between %g and %g", min, max)) {
+		return 0
+	}
+	return f
+}
+
+func (v *Validator) OneOf(field string, value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return v.Check(false, field, "must be one of "+strings.Join(allowed, ", "))
+}
+
+func (v *Validator) Valid() bool {
+	return len(v.errs) == 0
+}
+
+// Errors returns the recorded field errors, nil when every check passed.
+func (v *Validator) Errors() Errors {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
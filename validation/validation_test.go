@@ -0,0 +1,135 @@
+package validation
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRequired(t *testing.T) {
+	for _, value := range []string{"", " ", "\t\n"} {
+		v := New()
+		if v.Required("name", value) || v.Valid() {
+			t.Errorf("Required(%q) passed", value)
+		}
+	}
+	v := New()
+	if !v.Required("name", " Ana ") || !v.Valid() {
+		t.Errorf("Required(%q) failed: %v", " Ana ", v.Errors())
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max int
+		ok       bool
+	}{
+		{"abc", 1, 3, true},
+		{"abcd", 1, 3, false},
+		{"", 1, 3, false},
+		{"héllo", 5, 5, true}, // characters, not bytes
+		{"a long value", 1, 0, true},
+	}
+	for _, tt := range tests {
+		v := New()
+		if got := v.Length("f", tt.value, tt.min, tt.max); got != tt.ok {
+			t.Errorf("Length(%q, %d, %d) = %v, want %v", tt.value, tt.min, tt.max, got, tt.ok)
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	valid := []string{"user@example.com", "first.last+tag@sub.example.co.id"}
+	invalid := []string{"", "user", "user@", "@example.com", "user@localhost", "Ana <ana@example.com>", " user@example.com"}
+	for _, value := range valid {
+		if v := New(); !v.Email("email", value) {
+			t.Errorf("Email(%q) rejected", value)
+		}
+	}
+	for _, value := range invalid {
+		if v := New(); v.Email("email", value) {
+			t.Errorf("Email(%q) accepted", value)
+		}
+	}
+}
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"5", 5, true},
+		{" 7 ", 7, true},
+		{"0", 0, false},
+		{"11", 0, false},
+		{"2.5", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		v := New()
+		got := v.Int("n", tt.value, 1, 10)
+		if got != tt.want || v.Valid() != tt.ok {
+			t.Errorf("Int(%q) = %d, valid %v, want %d, %v", tt.value, got, v.Valid(), tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"12.5", 12.5, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"1e13", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"price", 0, false},
+	}
+	for _, tt := range tests {
+		v := New()
+		got := v.Float("price", tt.value, 0, 1e12)
+		if got != tt.want || v.Valid() != tt.ok || math.IsNaN(got) {
+			t.Errorf("Float(%q) = %g, valid %v, want %g, %v", tt.value, got, v.Valid(), tt.want, tt.ok)
+		}
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	v := New()
+	if !v.OneOf("state", "new", "new", "used") {
+		t.Error("OneOf rejected an allowed value")
+	}
+	if v.OneOf("state", "New", "new", "used") {
+		t.Error("OneOf is case sensitive but accepted New")
+	}
+	if got := v.Errors().Error(); got != "state: must be one of new, used" {
+		t.Errorf("message = %q", got)
+	}
+}
+
+// Only the first failed check of a field is reported, in the order fields were checked.
+func TestErrorsFirstPerField(t *testing.T) {
+	v := New()
+	v.Required("email", "")
+	v.Email("email", "")
+	v.Length("name", "", 1, 10)
+	v.Required("phone", "0812")
+
+	errs := v.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("Errors() = %v, want two fields", errs)
+	}
+	if errs[0] != (FieldError{Field: "email", Message: "is required"}) {
+		t.Errorf("first error = %+v", errs[0])
+	}
+	if errs[1].Field != "name" {
+		t.Errorf("second error = %+v", errs[1])
+	}
+	if New().Errors() != nil {
+		t.Error("Errors() of a fresh validator is not nil")
+	}
+}